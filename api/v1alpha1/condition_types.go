@@ -0,0 +1,109 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionType is the type of a condition of a Jwt or RotatingKey
+type ConditionType string
+
+const (
+	//The token is issued and valid, or the key is ready to sign tokens
+	ConditionReady ConditionType = "Ready"
+	//The signing key could be loaded from its backend
+	ConditionKeyAvailable ConditionType = "KeyAvailable"
+	//The token is signed with the current claims
+	ConditionSigned ConditionType = "Signed"
+	//The last reconciliation failed, the object may be outdated
+	ConditionDegraded ConditionType = "Degraded"
+)
+
+// Reasons of the conditions, also used as reasons of the events
+const (
+	ReasonReconciled          = "Reconciled"
+	ReasonKeyLoaded           = "KeyLoaded"
+	ReasonKeyCreated          = "KeyCreated"
+	ReasonKeyRotated          = "KeyRotated"
+	ReasonKeyPrepared         = "NextKeyPublished"
+	ReasonKeyRevoked          = "KeyRevoked"
+	ReasonKeyNotFound         = "RotatingKeyNotFound"
+	ReasonNamespaceNotAllowed = "NamespaceNotAllowed"
+	ReasonBackendUnavailable  = "BackendUnavailable"
+	ReasonKeyUnavailable      = "KeyUnavailable"
+	ReasonKeyGenerationFailed = "KeyGenerationFailed"
+	ReasonRotationFailed      = "RotationFailed"
+	ReasonPublishFailed       = "PublishFailed"
+	ReasonTokenIssued         = "TokenIssued"
+	ReasonTokenRefreshed      = "TokenRefreshed"
+	ReasonTokenValid          = "TokenValid"
+	ReasonClaimsUnresolved    = "ClaimsUnresolved"
+	ReasonInvalidLifetime     = "InvalidLifetime"
+	ReasonSigningFailed       = "SigningFailed"
+	ReasonUpdateFailed        = "UpdateFailed"
+	ReasonDestroyFailed       = "DestroyFailed"
+)
+
+// Condition describes an aspect of the state of a Jwt or RotatingKey
+type Condition struct {
+	Type ConditionType `json:"type"`
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	//Generation of the object the condition was set for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	//Last time the status of the condition changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+	//Machine readable reason of the last transition
+	Reason string `json:"reason"`
+	//Human readable details of the last transition
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// SetCondition adds or replaces the condition of the same type. The
+// transition time is kept as long as the status does not change.
+func SetCondition(conditions *[]Condition, condition Condition) {
+	if condition.LastTransitionTime.IsZero() {
+		condition.LastTransitionTime = metav1.Now()
+	}
+
+	for i, c := range *conditions {
+		if c.Type != condition.Type {
+			continue
+		}
+		if c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+		(*conditions)[i] = condition
+		return
+	}
+
+	*conditions = append(*conditions, condition)
+}
+
+// FindCondition returns the condition of the type, nil if it is not set.
+func FindCondition(conditions []Condition, conditionType ConditionType) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
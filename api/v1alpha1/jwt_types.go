@@ -17,7 +17,14 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // +genclient
@@ -25,6 +32,36 @@ import (
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// InjectAnnotation on a pod holds the name of a Jwt in the namespace of the
+// pod, whose token is mounted into all containers of the pod. The namespace
+// must enable the injection, see InjectNamespaceLabel.
+const InjectAnnotation = "tokens.hexhibit.xyz/inject"
+
+// InjectPathAnnotation overrides the directory the token is mounted at. The
+// token is the file "token" in the directory.
+const InjectPathAnnotation = "tokens.hexhibit.xyz/inject-path"
+
+// InjectEnvAnnotation holds the name of an environment variable set to the
+// path of the token file in all containers of the pod.
+const InjectEnvAnnotation = "tokens.hexhibit.xyz/inject-env"
+
+// InjectNamespaceLabel enables the injection of tokens into the pods of
+// namespaces labelled with the value "enabled", the pod webhook does not see
+// pods of other namespaces.
+const InjectNamespaceLabel = "tokens.hexhibit.xyz/injection"
+
+// ReservedClaims are the registered claims always set by the controller,
+// they can not be set by custom claims or claim sources.
+var ReservedClaims = map[string]bool{
+	"iss": true,
+	"sub": true,
+	"aud": true,
+	"exp": true,
+	"nbf": true,
+	"iat": true,
+	"jti": true,
+}
+
 // JwtSpec defines the desired state of Jwt
 type JwtSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
@@ -33,12 +70,94 @@ type JwtSpec struct {
 	//Subject set in token
 	Subject string `json:"subject"`
 
+	//Audiences the token is intended for, set as aud claim
+	// +kubebuilder:validation:MinItems=1
+	// +optional
+	Audiences []Audience `json:"audiences,omitempty"`
+
+	//Custom claims merged into the token payload. Registered claims (iss, sub, aud,
+	//exp, nbf, iat, jti) are reserved and can not be overwritten.
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +optional
+	Claims *runtime.RawExtension `json:"claims,omitempty"`
+
+	//Claims resolved at reconcile time from config maps, secrets or the
+	//metadata of the Jwt. The token is re-issued whenever a source changes.
+	// +optional
+	ClaimsFrom []ClaimSource `json:"claimsFrom,omitempty"`
+
 	RotatingKeyRef RotatingKeyRef `json:"rotatingKeyRef"`
+
+	//When to re-issue the token after the RotatingKey rotated. Immediate
+	//re-signs the token with the new key right away, Lazy keeps the token until
+	//it is refreshed. Tokens signed with a revoked key are always re-issued.
+	// +kubebuilder:validation:Enum=Immediate;Lazy
+	// +optional
+	ReissueOnRotation ReissuePolicy `json:"reissueOnRotation,omitempty"`
+
+	//Token lifetime, defaults to the lifetime of the RotatingKey. It must not
+	//exceed the maxLifetime of the RotatingKey.
+	// +optional
+	Lifetime string `json:"lifetime,omitempty"`
+
+	//Time before the expiry at which the token is refreshed, either a duration
+	//or a percentage of the lifetime like "20%". Defaults to 20%.
+	// +optional
+	RefreshBefore string `json:"refreshBefore,omitempty"`
+
+	//Upper bound of a random delay subtracted from the refresh time, so tokens
+	//issued together are not refreshed together. A duration or a percentage of
+	//the lifetime, disabled if empty.
+	// +optional
+	Jitter string `json:"jitter,omitempty"`
 }
 
+// Audience identifies a recipient of a token
+// +kubebuilder:validation:MinLength=1
+type Audience string
+
+// DefaultRefreshBefore is the refresh lead time of Jwts which do not set one,
+// they are re-issued after 80% of their lifetime.
+const DefaultRefreshBefore = "20%"
+
+// ReissuePolicy describes when a token is re-issued after a key rotation.
+type ReissuePolicy string
+
+const (
+	ReissueImmediate ReissuePolicy = "Immediate"
+	ReissueLazy      ReissuePolicy = "Lazy"
+)
+
+// ClaimSource describes a claim whose value is resolved from another object.
+// Exactly one of the sources must be set.
+type ClaimSource struct {
+	//Name of the claim
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	//Selects a key of a config map in the namespace of the Jwt
+	// +optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+
+	//Selects a key of a secret in the namespace of the Jwt
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+
+	//Selects a field of the Jwt, supports metadata.name, metadata.namespace,
+	//metadata.labels['<KEY>'] and metadata.annotations['<KEY>']
+	// +optional
+	FieldRef *corev1.ObjectFieldSelector `json:"fieldRef,omitempty"`
+}
+
+// RotatingKeyRef references the RotatingKey a token is signed with. Keys in
+// other namespaces must allow the namespace of the Jwt, see
+// AllowedNamespacesAnnotation.
 type RotatingKeyRef struct {
-	Name      string `json:"name"`
-	Namespace string `json:"namespace"`
+	Name string `json:"name"`
+	//Namespace of the RotatingKey, defaults to the namespace of the Jwt
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
 }
 
 // JwtStatus defines the observed state of Jwt
@@ -46,15 +165,28 @@ type JwtStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	//Token lifetime
-	Algorithm          string       `json:"algorithm"`
-	Lifetime           string       `json:"lifetime"`
-	Expired            bool         `json:"expired"`
-	ExpiresAt          metav1.Time  `json:"expiresAt"`
-	RefreshAfter       metav1.Time  `json:"refreshAfter"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Lifetime  string `json:"lifetime,omitempty"`
+	Expired   bool   `json:"expired"`
+	// Times are unset until the first token was issued
+	ExpiresAt          *metav1.Time `json:"expiresAt,omitempty"`
+	RefreshAfter       *metav1.Time `json:"refreshAfter,omitempty"`
 	LastRefresh        *metav1.Time `json:"lastRefresh,omitempty"`
-	NextReconcile      metav1.Time  `json:"nextReconcile,omitempty"`
-	LastTransitionTime metav1.Time  `json:"lastTransitionTime"`
+	NextReconcile      *metav1.Time `json:"nextReconcile,omitempty"`
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
 	Ready              bool         `json:"ready"`
+	//ID of the key the current token was signed with
+	KeyID string `json:"keyID,omitempty"`
+	//Hash of the claims the current token was issued with
+	ClaimsHash string `json:"claimsHash,omitempty"`
+	//Error of the last failed reconciliation
+	Error string `json:"error,omitempty"`
+	//Generation of the Jwt the status was last reconciled for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	//Ready, KeyAvailable, Signed and Degraded conditions of the token
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -78,6 +210,66 @@ type JwtList struct {
 	Items           []Jwt `json:"items"`
 }
 
+// Timing returns the lifetime of the token, how long before its expiry it is
+// refreshed and the jitter of the refresh. The lifetime defaults to the
+// lifetime of the RotatingKey and is bounded by its maximum lifetime, as
+// rotated keys are not kept for longer.
+func (r *Jwt) Timing(key RotatingKeySpec) (lifetime, refreshBefore, jitter time.Duration, err error) {
+	value := r.Spec.Lifetime
+	if value == "" {
+		value = key.Lifetime
+	}
+	lifetime, err = time.ParseDuration(value)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid lifetime: %v", err)
+	}
+
+	maxLifetime, err := time.ParseDuration(key.MaxTokenLifetime())
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid maximum lifetime of the rotating key: %v", err)
+	}
+	if lifetime <= 0 || lifetime > maxLifetime {
+		return 0, 0, 0, fmt.Errorf("lifetime %s exceeds the maximum lifetime %s of the rotating key", lifetime, maxLifetime)
+	}
+
+	value = r.Spec.RefreshBefore
+	if value == "" {
+		value = DefaultRefreshBefore
+	}
+	refreshBefore, err = ParseLifetimeFraction(value, lifetime)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid refreshBefore: %v", err)
+	}
+
+	if r.Spec.Jitter != "" {
+		jitter, err = ParseLifetimeFraction(r.Spec.Jitter, lifetime)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid jitter: %v", err)
+		}
+	}
+
+	if refreshBefore < 0 || jitter < 0 || refreshBefore+jitter >= lifetime {
+		return 0, 0, 0, fmt.Errorf("refreshBefore %s and jitter %s must be shorter than the lifetime %s", refreshBefore, jitter, lifetime)
+	}
+	return lifetime, refreshBefore, jitter, nil
+}
+
+// ParseLifetimeFraction parses a duration or a percentage of the lifetime.
+func ParseLifetimeFraction(value string, lifetime time.Duration) (time.Duration, error) {
+	if !strings.HasSuffix(value, "%") {
+		return time.ParseDuration(value)
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", value)
+	}
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("percentage %q out of range", value)
+	}
+	return time.Duration(float64(lifetime) * percent / 100), nil
+}
+
 func init() {
 	SchemeBuilder.Register(&Jwt{}, &JwtList{})
 }
@@ -0,0 +1,104 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLifetimeFraction(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "10m", want: 10 * time.Minute},
+		{value: "0s", want: 0},
+		{value: "20%", want: 12 * time.Minute},
+		{value: "12.5%", want: 450 * time.Second},
+		{value: "0%", want: 0},
+		{value: "100%", want: time.Hour},
+		{value: "101%", wantErr: true},
+		{value: "-1%", wantErr: true},
+		{value: "%", wantErr: true},
+		{value: "ten%", wantErr: true},
+		{value: "10", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseLifetimeFraction(tt.value, time.Hour)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTiming(t *testing.T) {
+	key := RotatingKeySpec{Lifetime: "1h", MaxLifetime: "2h"}
+
+	tests := []struct {
+		name          string
+		spec          JwtSpec
+		key           *RotatingKeySpec
+		lifetime      time.Duration
+		refreshBefore time.Duration
+		jitter        time.Duration
+		wantErr       bool
+	}{
+		{name: "defaults", lifetime: time.Hour, refreshBefore: 12 * time.Minute},
+		{name: "lifetime", spec: JwtSpec{Lifetime: "2h"}, lifetime: 2 * time.Hour, refreshBefore: 24 * time.Minute},
+		{name: "lifetime without maximum", spec: JwtSpec{Lifetime: "30m"}, key: &RotatingKeySpec{Lifetime: "1h"}, lifetime: 30 * time.Minute, refreshBefore: 6 * time.Minute},
+		{name: "lifetime exceeds maximum", spec: JwtSpec{Lifetime: "3h"}, wantErr: true},
+		{name: "lifetime exceeds key lifetime", spec: JwtSpec{Lifetime: "2h"}, key: &RotatingKeySpec{Lifetime: "1h"}, wantErr: true},
+		{name: "invalid lifetime", spec: JwtSpec{Lifetime: "1 hour"}, wantErr: true},
+		{name: "negative lifetime", spec: JwtSpec{Lifetime: "-1h"}, wantErr: true},
+		{name: "invalid key lifetime", key: &RotatingKeySpec{Lifetime: "1 hour"}, wantErr: true},
+		{name: "refreshBefore", spec: JwtSpec{RefreshBefore: "5m"}, lifetime: time.Hour, refreshBefore: 5 * time.Minute},
+		{name: "refreshBefore percentage", spec: JwtSpec{RefreshBefore: "50%"}, lifetime: time.Hour, refreshBefore: 30 * time.Minute},
+		{name: "invalid refreshBefore", spec: JwtSpec{RefreshBefore: "soon"}, wantErr: true},
+		{name: "negative refreshBefore", spec: JwtSpec{RefreshBefore: "-5m"}, wantErr: true},
+		{name: "refreshBefore is lifetime", spec: JwtSpec{RefreshBefore: "1h"}, wantErr: true},
+		{name: "jitter", spec: JwtSpec{Jitter: "10%"}, lifetime: time.Hour, refreshBefore: 12 * time.Minute, jitter: 6 * time.Minute},
+		{name: "invalid jitter", spec: JwtSpec{Jitter: "150%"}, wantErr: true},
+		{name: "refreshBefore and jitter exceed lifetime", spec: JwtSpec{RefreshBefore: "50%", Jitter: "50%"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := key
+			if tt.key != nil {
+				spec = *tt.key
+			}
+
+			jwt := &Jwt{Spec: tt.spec}
+			lifetime, refreshBefore, jitter, err := jwt.Timing(spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if lifetime != tt.lifetime || refreshBefore != tt.refreshBefore || jitter != tt.jitter {
+				t.Errorf("got lifetime %s, refreshBefore %s, jitter %s, want %s, %s, %s",
+					lifetime, refreshBefore, jitter, tt.lifetime, tt.refreshBefore, tt.jitter)
+			}
+		})
+	}
+}
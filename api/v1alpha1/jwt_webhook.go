@@ -0,0 +1,229 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// JwtValidatorPath is the path the Jwt validator is served at
+const JwtValidatorPath = "/validate-tokens-hexhibit-xyz-v1alpha1-jwt"
+
+// SetupWebhookWithManager registers the defaulting webhook of the Jwt and
+// the JwtValidator, which looks up the referenced RotatingKeys with the
+// client of the manager.
+func (r *Jwt) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	err := ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+	if err != nil {
+		return err
+	}
+
+	mgr.GetWebhookServer().Register(JwtValidatorPath, &webhook.Admission{Handler: &JwtValidator{Client: mgr.GetClient()}})
+	return nil
+}
+
+// +kubebuilder:webhook:path=/mutate-tokens-hexhibit-xyz-v1alpha1-jwt,mutating=true,failurePolicy=fail,groups=tokens.hexhibit.xyz,resources=jwts,verbs=create;update,versions=v1alpha1,name=mjwt.tokens.hexhibit.xyz
+
+var _ webhook.Defaulter = &Jwt{}
+
+// Default sets the namespace of the RotatingKey and the re-issue policy.
+func (r *Jwt) Default() {
+	if r.Spec.RotatingKeyRef.Namespace == "" {
+		r.Spec.RotatingKeyRef.Namespace = r.Namespace
+	}
+	if r.Spec.ReissueOnRotation == "" {
+		r.Spec.ReissueOnRotation = ReissueImmediate
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-tokens-hexhibit-xyz-v1alpha1-jwt,mutating=false,failurePolicy=fail,groups=tokens.hexhibit.xyz,resources=jwts,versions=v1alpha1,name=vjwt.tokens.hexhibit.xyz
+
+// JwtValidator validates the spec of Jwts and the RotatingKey they reference.
+// +kubebuilder:object:generate=false
+type JwtValidator struct {
+	// Client looks up the referenced RotatingKeys
+	Client client.Reader
+
+	decoder *admission.Decoder
+}
+
+// InjectDecoder is called by the webhook server.
+func (v *JwtValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+func (v *JwtValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	jwt := &Jwt{}
+	err := v.decoder.DecodeRaw(req.Object, jwt)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	switch req.Operation {
+	case admissionv1beta1.Create:
+		err = v.ValidateCreate(ctx, jwt)
+	case admissionv1beta1.Update:
+		old := &Jwt{}
+		err = v.decoder.DecodeRaw(req.OldObject, old)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		err = v.ValidateUpdate(ctx, jwt, old)
+	}
+	if err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+func (v *JwtValidator) ValidateCreate(ctx context.Context, jwt *Jwt) error {
+	errs := jwt.validateSpec()
+	errs = append(errs, v.validateRotatingKey(ctx, jwt, field.NewPath("spec"))...)
+	return jwt.invalid(errs)
+}
+
+// ValidateUpdate only checks the RotatingKey if the reference or the timing
+// changed, so Jwts of a deleted key can still be updated. An unchanged spec is
+// not validated again, so tokens admitted by earlier rules can still be
+// labeled or annotated.
+func (v *JwtValidator) ValidateUpdate(ctx context.Context, jwt, old *Jwt) error {
+	// Jwts created without the defaulting webhook use the defaults
+	oldJwt := old.DeepCopy()
+	oldJwt.Default()
+	newJwt := jwt.DeepCopy()
+	newJwt.Default()
+
+	var errs field.ErrorList
+	if !reflect.DeepEqual(oldJwt.Spec, newJwt.Spec) {
+		errs = jwt.validateSpec()
+	}
+
+	oldSpec := old.Spec
+	if jwt.Spec.RotatingKeyRef != oldSpec.RotatingKeyRef ||
+		jwt.Spec.Lifetime != oldSpec.Lifetime ||
+		jwt.Spec.RefreshBefore != oldSpec.RefreshBefore ||
+		jwt.Spec.Jitter != oldSpec.Jitter {
+		errs = append(errs, v.validateRotatingKey(ctx, jwt, field.NewPath("spec"))...)
+	}
+	return jwt.invalid(errs)
+}
+
+func (r *Jwt) validateSpec() field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+
+	for i, audience := range r.Spec.Audiences {
+		if strings.TrimSpace(string(audience)) == "" {
+			errs = append(errs, field.Invalid(spec.Child("audiences").Index(i), audience, "must not be blank"))
+		}
+	}
+
+	if r.Spec.Claims != nil && len(r.Spec.Claims.Raw) > 0 {
+		path := spec.Child("claims")
+		claims := map[string]interface{}{}
+		decoder := json.NewDecoder(bytes.NewReader(r.Spec.Claims.Raw))
+		decoder.UseNumber()
+		err := decoder.Decode(&claims)
+		if err != nil {
+			errs = append(errs, field.Invalid(path, string(r.Spec.Claims.Raw), "must be an object"))
+		}
+		for k := range claims {
+			if ReservedClaims[k] {
+				errs = append(errs, field.Forbidden(path.Key(k), fmt.Sprintf("claim %s is reserved", k)))
+			}
+		}
+	}
+
+	for i, source := range r.Spec.ClaimsFrom {
+		path := spec.Child("claimsFrom").Index(i)
+		if ReservedClaims[source.Name] {
+			errs = append(errs, field.Forbidden(path.Child("name"), fmt.Sprintf("claim %s is reserved", source.Name)))
+		}
+
+		set := 0
+		for _, isSet := range []bool{source.ConfigMapKeyRef != nil, source.SecretKeyRef != nil, source.FieldRef != nil} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			errs = append(errs, field.Invalid(path, source.Name, "exactly one of configMapKeyRef, secretKeyRef and fieldRef must be set"))
+		}
+	}
+
+	return errs
+}
+
+// validateRotatingKey rejects references to missing RotatingKeys and to keys
+// which do not allow the namespace of the Jwt or its lifetime.
+func (v *JwtValidator) validateRotatingKey(ctx context.Context, r *Jwt, spec *field.Path) field.ErrorList {
+	path := spec.Child("rotatingKeyRef")
+	ref := r.Spec.RotatingKeyRef
+	if ref.Name == "" {
+		return field.ErrorList{field.Required(path.Child("name"), "")}
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = r.Namespace
+	}
+	name := types.NamespacedName{Name: ref.Name, Namespace: namespace}
+
+	key := &RotatingKey{}
+	err := v.Client.Get(ctx, name, key)
+	if apierrors.IsNotFound(err) {
+		return field.ErrorList{field.NotFound(path, name.String())}
+	} else if err != nil {
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+
+	if !key.AllowsNamespace(r.Namespace) {
+		return field.ErrorList{field.Forbidden(path, fmt.Sprintf("rotating key %s does not allow namespace %s, see annotation %s", name, r.Namespace, AllowedNamespacesAnnotation))}
+	}
+
+	_, _, _, err = r.Timing(key.Spec)
+	if err != nil {
+		return field.ErrorList{field.Invalid(spec.Child("lifetime"), r.Spec.Lifetime, err.Error())}
+	}
+	return nil
+}
+
+// invalid returns the validation errors as API error
+func (r *Jwt) invalid(errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Jwt").GroupKind(), r.Name, errs)
+}
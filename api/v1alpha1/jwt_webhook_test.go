@@ -0,0 +1,194 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newTestJwtValidator(t *testing.T) *JwtValidator {
+	scheme := runtime.NewScheme()
+	err := AddToScheme(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := testRotatingKey(nil)
+	shared := testRotatingKey(nil)
+	shared.Name = "shared"
+	shared.Annotations = map[string]string{AllowedNamespacesAnnotation: "tokens"}
+
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := &JwtValidator{Client: fake.NewFakeClientWithScheme(scheme, key, shared)}
+	err = validator.InjectDecoder(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return validator
+}
+
+func testJwt(update func(*Jwt)) *Jwt {
+	jwt := &Jwt{
+		ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+		Spec: JwtSpec{
+			Subject:        "subject",
+			RotatingKeyRef: RotatingKeyRef{Name: "key", Namespace: "default"},
+		},
+	}
+	if update != nil {
+		update(jwt)
+	}
+	return jwt
+}
+
+func TestJwtValidateCreate(t *testing.T) {
+	fieldRef := &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}
+
+	tests := []struct {
+		name    string
+		jwt     func(*Jwt)
+		wantErr bool
+	}{
+		{name: "valid"},
+		{name: "audiences", jwt: func(j *Jwt) { j.Spec.Audiences = []Audience{"api", "web"} }},
+		{name: "empty audience", jwt: func(j *Jwt) { j.Spec.Audiences = []Audience{"api", ""} }, wantErr: true},
+		{name: "blank audience", jwt: func(j *Jwt) { j.Spec.Audiences = []Audience{" \t"} }, wantErr: true},
+		{name: "custom claims", jwt: func(j *Jwt) { j.Spec.Claims = &runtime.RawExtension{Raw: []byte(`{"role":"reader"}`)} }},
+		{name: "custom claims not an object", jwt: func(j *Jwt) { j.Spec.Claims = &runtime.RawExtension{Raw: []byte(`["role"]`)} }, wantErr: true},
+		{name: "reserved custom claim", jwt: func(j *Jwt) { j.Spec.Claims = &runtime.RawExtension{Raw: []byte(`{"exp":0}`)} }, wantErr: true},
+		{name: "claim source", jwt: func(j *Jwt) { j.Spec.ClaimsFrom = []ClaimSource{{Name: "name", FieldRef: fieldRef}} }},
+		{name: "reserved claim source", jwt: func(j *Jwt) { j.Spec.ClaimsFrom = []ClaimSource{{Name: "sub", FieldRef: fieldRef}} }, wantErr: true},
+		{name: "claim source without source", jwt: func(j *Jwt) { j.Spec.ClaimsFrom = []ClaimSource{{Name: "name"}} }, wantErr: true},
+		{name: "claim source with two sources", jwt: func(j *Jwt) {
+			j.Spec.ClaimsFrom = []ClaimSource{{Name: "name", FieldRef: fieldRef, ConfigMapKeyRef: &corev1.ConfigMapKeySelector{Key: "name"}}}
+		}, wantErr: true},
+		{name: "missing key reference", jwt: func(j *Jwt) { j.Spec.RotatingKeyRef.Name = "" }, wantErr: true},
+		{name: "missing key", jwt: func(j *Jwt) { j.Spec.RotatingKeyRef.Name = "missing" }, wantErr: true},
+		{name: "key in allowed namespace", jwt: func(j *Jwt) { j.Namespace = "tokens"; j.Spec.RotatingKeyRef.Name = "shared" }},
+		{name: "key in other namespace", jwt: func(j *Jwt) { j.Namespace = "tokens" }, wantErr: true},
+		{name: "lifetime", jwt: func(j *Jwt) { j.Spec.Lifetime = "30m" }},
+		{name: "lifetime exceeds key", jwt: func(j *Jwt) { j.Spec.Lifetime = "2h" }, wantErr: true},
+		{name: "refreshBefore exceeds lifetime", jwt: func(j *Jwt) { j.Spec.RefreshBefore = "100%" }, wantErr: true},
+	}
+
+	validator := newTestJwtValidator(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.ValidateCreate(context.Background(), testJwt(tt.jwt))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJwtValidateUpdate(t *testing.T) {
+	deletedKey := func(j *Jwt) { j.Spec.RotatingKeyRef.Name = "deleted" }
+	// Admitted before claim sources were checked for reserved claims
+	reservedClaim := func(j *Jwt) {
+		j.Spec.ClaimsFrom = []ClaimSource{{Name: "iss", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}}
+	}
+
+	tests := []struct {
+		name    string
+		old     func(*Jwt)
+		jwt     func(*Jwt)
+		wantErr bool
+	}{
+		{name: "unchanged"},
+		{name: "subject of deleted key changed", old: deletedKey, jwt: func(j *Jwt) { deletedKey(j); j.Spec.Subject = "other" }},
+		{name: "lifetime of deleted key changed", old: deletedKey, jwt: func(j *Jwt) { deletedKey(j); j.Spec.Lifetime = "30m" }, wantErr: true},
+		{name: "reference to missing key", jwt: func(j *Jwt) { j.Spec.RotatingKeyRef.Name = "missing" }, wantErr: true},
+		{name: "lifetime exceeds key", jwt: func(j *Jwt) { j.Spec.Lifetime = "2h" }, wantErr: true},
+		{name: "jitter exceeds lifetime", jwt: func(j *Jwt) { j.Spec.Jitter = "80%" }, wantErr: true},
+		{name: "reserved claim source", jwt: func(j *Jwt) {
+			j.Spec.ClaimsFrom = []ClaimSource{{Name: "iss", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}}
+		}, wantErr: true},
+		{name: "labels of unchanged reserved claim", old: reservedClaim, jwt: func(j *Jwt) {
+			reservedClaim(j)
+			j.Labels = map[string]string{"team": "tokens"}
+		}},
+		{name: "defaults of unchanged reserved claim", old: reservedClaim, jwt: func(j *Jwt) {
+			reservedClaim(j)
+			j.Default()
+		}},
+	}
+
+	validator := newTestJwtValidator(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.ValidateUpdate(context.Background(), testJwt(tt.jwt), testJwt(tt.old))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJwtValidatorHandle(t *testing.T) {
+	raw := func(jwt *Jwt) runtime.RawExtension {
+		encoded, err := json.Marshal(jwt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: encoded}
+	}
+	missingKey := testJwt(func(j *Jwt) { j.Spec.RotatingKeyRef.Name = "missing" })
+
+	tests := []struct {
+		name      string
+		operation admissionv1beta1.Operation
+		jwt       *Jwt
+		old       *Jwt
+		allowed   bool
+	}{
+		{name: "create", operation: admissionv1beta1.Create, jwt: testJwt(nil), allowed: true},
+		{name: "create with missing key", operation: admissionv1beta1.Create, jwt: missingKey},
+		{name: "update", operation: admissionv1beta1.Update, jwt: testJwt(nil), old: testJwt(nil), allowed: true},
+		{name: "update to missing key", operation: admissionv1beta1.Update, jwt: missingKey, old: testJwt(nil)},
+	}
+
+	validator := newTestJwtValidator(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+				Operation: tt.operation,
+				Object:    raw(tt.jwt),
+			}}
+			if tt.old != nil {
+				req.OldObject = raw(tt.old)
+			}
+
+			resp := validator.Handle(context.Background(), req)
+			if resp.Allowed != tt.allowed {
+				t.Errorf("got allowed %t, want %t: %v", resp.Allowed, tt.allowed, resp.Result)
+			}
+		})
+	}
+}
@@ -17,32 +17,109 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"strings"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// AllowedNamespacesAnnotation holds a comma separated list of namespaces whose
+// Jwts may be signed with the RotatingKey, "*" allows all namespaces. Jwts in
+// the namespace of the RotatingKey are always allowed.
+const AllowedNamespacesAnnotation = "tokens.hexhibit.xyz/allowed-namespaces"
+
+// RotateNowAnnotation forces an immediate rotation of the RotatingKey whenever
+// its value changes, e.g. to the current timestamp.
+const RotateNowAnnotation = "tokens.hexhibit.xyz/rotate-now"
+
+// RevokeAnnotation holds a comma separated list of compromised key IDs, which
+// are dropped from the verification keys right away. A revoked signing key is
+// rotated first, as is the signing key of a revoked successor held by the
+// vaultTransit backend. All Jwts signed with a revoked key are re-issued.
+const RevokeAnnotation = "tokens.hexhibit.xyz/revoke"
+
+// KeysFinalizer is set on RotatingKeys whose backend holds the private keys
+// outside of the secret. It is removed once the keys were destroyed.
+const KeysFinalizer = "tokens.hexhibit.xyz/destroy-keys"
+
 // RotatingKeySpec defines the desired state of RotatingKey
 type RotatingKeySpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	//JSON Web Signature and Encryption Algorithms
-	// +kubebuilder:validation:Enum=RS256
-	Algorithm   string `json:"algorithm"`
+	//JSON Web Signature and Encryption Algorithms, defaults to RS256. HS256, HS384
+	//and HS512 use shared secrets, which are kept in the secret of the key and
+	//never published.
+	// +kubebuilder:validation:Enum=RS256;RS384;RS512;PS256;PS384;PS512;ES256;ES384;ES512;EdDSA;HS256;HS384;HS512
+	// +optional
+	Algorithm   string `json:"algorithm,omitempty"`
 	RotateAfter string `json:"rotateAfter"`
 	//Token lifetime
 	Lifetime string `json:"lifetime"`
+
+	//Longest lifetime of Jwts signed with this key, defaults to lifetime.
+	//Rotated keys are kept for verification until tokens of this lifetime
+	//expired.
+	// +optional
+	MaxLifetime string `json:"maxLifetime,omitempty"`
+
+	//Lead time before the rotation at which the next signing key is generated
+	//and published as verification key, so verifiers know it before the first
+	//token is signed with it. Disabled if empty.
+	// +optional
+	PublishBefore string `json:"publishBefore,omitempty"`
+
+	//Size of RSA keys in bits, defaults to 2048. Ignored for all other algorithms.
+	// +kubebuilder:validation:Enum=2048;3072;4096
+	// +optional
+	KeySize int `json:"keySize,omitempty"`
+
+	//Issuing authority, set as iss claim in every token signed with this key
+	// +kubebuilder:validation:Format=uri
+	// +optional
+	Issuer string `json:"issuer,omitempty"`
+
+	//Backend holding the signing keys, defaults to local. Local keys are stored
+	//in the secret of the key, pkcs11 keys never leave the PKCS#11 token
+	//configured for the operator and only their label is stored in the secret.
+	//vaultTransit keys are generated, rotated and used for signing by the vault
+	//transit engine configured for the operator, the key is named
+	//<namespace>.<name> of the RotatingKey.
+	// +kubebuilder:validation:Enum=local;pkcs11;vaultTransit
+	// +optional
+	Backend KeyBackend `json:"backend,omitempty"`
 }
 
+// KeyBackend is the backend generating and holding the signing keys
+type KeyBackend string
+
+const (
+	KeyBackendLocal  KeyBackend = "local"
+	KeyBackendPKCS11 KeyBackend = "pkcs11"
+	KeyBackendVault  KeyBackend = "vaultTransit"
+)
+
 // RotatingKeyStatus defines the observed state of RotatingKey
 type RotatingKeyStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
-	NexRotation      metav1.Time     `json:"nextRotation"`
-	VerificationKeys []ValidationKey `json:"validationKeys"`
+	// Unset until the first key was generated
+	NexRotation      *metav1.Time    `json:"nextRotation,omitempty"`
+	VerificationKeys []ValidationKey `json:"validationKeys,omitempty"`
 	SigningKey       SigningKey      `json:"signingKeys"`
+
+	//Value of the rotate-now annotation the last forced rotation was done for
+	// +optional
+	LastRotateNow string `json:"lastRotateNow,omitempty"`
+
+	//Generation of the RotatingKey the status was last reconciled for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	//Ready, KeyAvailable and Degraded conditions of the key
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
 }
 
 type ValidationKey struct {
@@ -79,6 +156,31 @@ type RotatingKeyList struct {
 	Items           []RotatingKey `json:"items"`
 }
 
+// MaxTokenLifetime returns the longest lifetime of tokens signed with the key.
+func (s RotatingKeySpec) MaxTokenLifetime() string {
+	if s.MaxLifetime != "" {
+		return s.MaxLifetime
+	}
+	return s.Lifetime
+}
+
+// AllowsNamespace reports whether Jwts in the namespace may be signed with the
+// key.
+func (r *RotatingKey) AllowsNamespace(namespace string) bool {
+	if r.Namespace == namespace {
+		return true
+	}
+
+	allowed := r.Annotations[AllowedNamespacesAnnotation]
+	for _, n := range strings.Split(allowed, ",") {
+		n = strings.TrimSpace(n)
+		if n == "*" || n == namespace {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	SchemeBuilder.Register(&RotatingKey{}, &RotatingKeyList{})
 }
@@ -0,0 +1,191 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// DefaultAlgorithm is the algorithm of keys which do not set one
+const DefaultAlgorithm = "RS256"
+
+// DefaultRSAKeySize is the size of RSA keys which do not set one
+const DefaultRSAKeySize = 2048
+
+// MinRotateAfter is the shortest supported rotation period, every reconcile
+// would rotate the key otherwise
+const MinRotateAfter = time.Minute
+
+// Algorithms supported by each key backend
+var backendAlgorithms = map[KeyBackend][]string{
+	KeyBackendLocal:  {"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA", "HS256", "HS384", "HS512"},
+	KeyBackendPKCS11: {"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"},
+	KeyBackendVault:  {"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"},
+}
+
+func (r *RotatingKey) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-tokens-hexhibit-xyz-v1alpha1-rotatingkey,mutating=true,failurePolicy=fail,groups=tokens.hexhibit.xyz,resources=rotatingkeys,verbs=create;update,versions=v1alpha1,name=mrotatingkey.tokens.hexhibit.xyz
+
+var _ webhook.Defaulter = &RotatingKey{}
+
+// Default sets the algorithm, its key size and the backend.
+func (r *RotatingKey) Default() {
+	if r.Spec.Algorithm == "" {
+		r.Spec.Algorithm = DefaultAlgorithm
+	}
+	if r.Spec.KeySize == 0 && isRSA(r.Spec.Algorithm) {
+		r.Spec.KeySize = DefaultRSAKeySize
+	}
+	if r.Spec.Backend == "" {
+		r.Spec.Backend = KeyBackendLocal
+	}
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-tokens-hexhibit-xyz-v1alpha1-rotatingkey,mutating=false,failurePolicy=fail,groups=tokens.hexhibit.xyz,resources=rotatingkeys,versions=v1alpha1,name=vrotatingkey.tokens.hexhibit.xyz
+
+var _ webhook.Validator = &RotatingKey{}
+
+func (r *RotatingKey) ValidateCreate() error {
+	return r.invalid(r.validateSpec())
+}
+
+// ValidateUpdate additionally rejects changes of the algorithm and backend,
+// which can not load the keys stored for the previous ones. An unchanged spec
+// is not validated again, so keys admitted by earlier rules can still be
+// annotated.
+func (r *RotatingKey) ValidateUpdate(old runtime.Object) error {
+	// Keys created without the defaulting webhook use the defaults
+	oldKey := old.(*RotatingKey).DeepCopy()
+	oldKey.Default()
+	newKey := r.DeepCopy()
+	newKey.Default()
+
+	var errs field.ErrorList
+	if !reflect.DeepEqual(oldKey.Spec, newKey.Spec) {
+		errs = r.validateSpec()
+	}
+
+	spec := field.NewPath("spec")
+	if newKey.Spec.Algorithm != oldKey.Spec.Algorithm {
+		errs = append(errs, field.Forbidden(spec.Child("algorithm"), "the algorithm of existing keys can not be changed"))
+	}
+	if newKey.Spec.Backend != oldKey.Spec.Backend {
+		errs = append(errs, field.Forbidden(spec.Child("backend"), "the backend of existing keys can not be changed"))
+	}
+
+	return r.invalid(errs)
+}
+
+func (r *RotatingKey) ValidateDelete() error {
+	return nil
+}
+
+func (r *RotatingKey) validateSpec() field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+
+	backend := r.Spec.Backend
+	if backend == "" {
+		backend = KeyBackendLocal
+	}
+	if !contains(backendAlgorithms[backend], r.Spec.Algorithm) {
+		errs = append(errs, field.NotSupported(spec.Child("algorithm"), r.Spec.Algorithm, backendAlgorithms[backend]))
+	}
+
+	rotateAfter, err := parseDuration(spec.Child("rotateAfter"), r.Spec.RotateAfter)
+	if err != nil {
+		errs = append(errs, err)
+	} else if rotateAfter < MinRotateAfter {
+		errs = append(errs, field.Invalid(spec.Child("rotateAfter"), r.Spec.RotateAfter, fmt.Sprintf("must be at least %s", MinRotateAfter)))
+	}
+
+	lifetime, err := parseDuration(spec.Child("lifetime"), r.Spec.Lifetime)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if r.Spec.MaxLifetime != "" {
+		maxLifetime, err := parseDuration(spec.Child("maxLifetime"), r.Spec.MaxLifetime)
+		if err != nil {
+			errs = append(errs, err)
+		} else if maxLifetime < lifetime {
+			errs = append(errs, field.Invalid(spec.Child("maxLifetime"), r.Spec.MaxLifetime, "must not be shorter than lifetime"))
+		}
+	}
+
+	if r.Spec.PublishBefore != "" {
+		publishBefore, err := parseDuration(spec.Child("publishBefore"), r.Spec.PublishBefore)
+		if err != nil {
+			errs = append(errs, err)
+		} else if rotateAfter > 0 && publishBefore >= rotateAfter {
+			errs = append(errs, field.Invalid(spec.Child("publishBefore"), r.Spec.PublishBefore, "must be shorter than rotateAfter"))
+		}
+	}
+
+	return errs
+}
+
+// invalid returns the validation errors as API error
+func (r *RotatingKey) invalid(errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("RotatingKey").GroupKind(), r.Name, errs)
+}
+
+// parseDuration parses a positive duration of the field.
+func parseDuration(path *field.Path, value string) (time.Duration, *field.Error) {
+	if value == "" {
+		return 0, field.Required(path, "")
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, field.Invalid(path, value, err.Error())
+	}
+	if d <= 0 {
+		return 0, field.Invalid(path, value, "must be positive")
+	}
+	return d, nil
+}
+
+func isRSA(algorithm string) bool {
+	return strings.HasPrefix(algorithm, "RS") || strings.HasPrefix(algorithm, "PS")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
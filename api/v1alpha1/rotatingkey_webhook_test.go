@@ -0,0 +1,98 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testRotatingKey(update func(*RotatingKeySpec)) *RotatingKey {
+	key := &RotatingKey{
+		ObjectMeta: metav1.ObjectMeta{Name: "key", Namespace: "default"},
+		Spec: RotatingKeySpec{
+			Algorithm:   "RS256",
+			RotateAfter: "24h",
+			Lifetime:    "1h",
+			Backend:     KeyBackendLocal,
+		},
+	}
+	if update != nil {
+		update(&key.Spec)
+	}
+	return key
+}
+
+func TestRotatingKeyValidateCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    func(*RotatingKeySpec)
+		wantErr bool
+	}{
+		{name: "valid"},
+		{name: "algorithm of other backend", spec: func(s *RotatingKeySpec) { s.Algorithm = "HS256"; s.Backend = KeyBackendVault }, wantErr: true},
+		{name: "unknown algorithm", spec: func(s *RotatingKeySpec) { s.Algorithm = "none" }, wantErr: true},
+		{name: "missing rotateAfter", spec: func(s *RotatingKeySpec) { s.RotateAfter = "" }, wantErr: true},
+		{name: "rotateAfter too short", spec: func(s *RotatingKeySpec) { s.RotateAfter = "30s" }, wantErr: true},
+		{name: "invalid lifetime", spec: func(s *RotatingKeySpec) { s.Lifetime = "1 hour" }, wantErr: true},
+		{name: "negative lifetime", spec: func(s *RotatingKeySpec) { s.Lifetime = "-1h" }, wantErr: true},
+		{name: "maxLifetime shorter than lifetime", spec: func(s *RotatingKeySpec) { s.MaxLifetime = "30m" }, wantErr: true},
+		{name: "lifetime spanning many rotations", spec: func(s *RotatingKeySpec) { s.RotateAfter = "1h"; s.Lifetime = "48h" }},
+		{name: "publishBefore", spec: func(s *RotatingKeySpec) { s.PublishBefore = "1h" }},
+		{name: "publishBefore not shorter than rotateAfter", spec: func(s *RotatingKeySpec) { s.PublishBefore = "24h" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testRotatingKey(tt.spec).ValidateCreate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotatingKeyValidateUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     func(*RotatingKeySpec)
+		spec    func(*RotatingKeySpec)
+		wantErr bool
+	}{
+		{name: "unchanged"},
+		{name: "rotateAfter changed", spec: func(s *RotatingKeySpec) { s.RotateAfter = "12h" }},
+		{name: "invalid spec unchanged", old: func(s *RotatingKeySpec) { s.RotateAfter = "30s" }, spec: func(s *RotatingKeySpec) { s.RotateAfter = "30s" }},
+		{name: "invalid spec defaulted", old: func(s *RotatingKeySpec) { s.RotateAfter = "30s"; s.Algorithm = "" }, spec: func(s *RotatingKeySpec) { s.RotateAfter = "30s" }},
+		{name: "invalid spec changed", spec: func(s *RotatingKeySpec) { s.RotateAfter = "30s" }, wantErr: true},
+		{name: "algorithm changed", spec: func(s *RotatingKeySpec) { s.Algorithm = "ES256" }, wantErr: true},
+		{name: "backend changed", spec: func(s *RotatingKeySpec) { s.Backend = KeyBackendVault }, wantErr: true},
+		{name: "default algorithm set", old: func(s *RotatingKeySpec) { s.Algorithm = "" }},
+		{name: "algorithm changed from default", old: func(s *RotatingKeySpec) { s.Algorithm = "" }, spec: func(s *RotatingKeySpec) { s.Algorithm = "ES256" }, wantErr: true},
+		{name: "default backend set", old: func(s *RotatingKeySpec) { s.Backend = "" }},
+		{name: "backend changed from default", old: func(s *RotatingKeySpec) { s.Backend = "" }, spec: func(s *RotatingKeySpec) { s.Backend = KeyBackendVault }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testRotatingKey(tt.spec).ValidateUpdate(testRotatingKey(tt.old))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
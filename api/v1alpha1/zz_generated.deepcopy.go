@@ -21,15 +21,62 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/api/core/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClaimSource) DeepCopyInto(out *ClaimSource) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.FieldRef != nil {
+		in, out := &in.FieldRef, &out.FieldRef
+		*out = new(v1.ObjectFieldSelector)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClaimSource.
+func (in *ClaimSource) DeepCopy() *ClaimSource {
+	if in == nil {
+		return nil
+	}
+	out := new(ClaimSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Condition) DeepCopyInto(out *Condition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
+func (in *Condition) DeepCopy() *Condition {
+	if in == nil {
+		return nil
+	}
+	out := new(Condition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Jwt) DeepCopyInto(out *Jwt) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	in.Status.DeepCopyInto(&out.Status)
 }
 
@@ -86,6 +133,24 @@ func (in *JwtList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *JwtSpec) DeepCopyInto(out *JwtSpec) {
 	*out = *in
+	if in.Audiences != nil {
+		in, out := &in.Audiences, &out.Audiences
+		*out = make([]Audience, len(*in))
+		copy(*out, *in)
+	}
+	if in.Claims != nil {
+		in, out := &in.Claims, &out.Claims
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ClaimsFrom != nil {
+		in, out := &in.ClaimsFrom, &out.ClaimsFrom
+		*out = make([]ClaimSource, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.RotatingKeyRef = in.RotatingKeyRef
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JwtSpec.
@@ -101,14 +166,33 @@ func (in *JwtSpec) DeepCopy() *JwtSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *JwtStatus) DeepCopyInto(out *JwtStatus) {
 	*out = *in
-	in.ExpiresAt.DeepCopyInto(&out.ExpiresAt)
-	in.RefreshAfter.DeepCopyInto(&out.RefreshAfter)
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.RefreshAfter != nil {
+		in, out := &in.RefreshAfter, &out.RefreshAfter
+		*out = (*in).DeepCopy()
+	}
 	if in.LastRefresh != nil {
 		in, out := &in.LastRefresh, &out.LastRefresh
 		*out = (*in).DeepCopy()
 	}
-	in.NextReconcile.DeepCopyInto(&out.NextReconcile)
-	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	if in.NextReconcile != nil {
+		in, out := &in.NextReconcile, &out.NextReconcile
+		*out = (*in).DeepCopy()
+	}
+	if in.LastTransitionTime != nil {
+		in, out := &in.LastTransitionTime, &out.LastTransitionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JwtStatus.
@@ -180,6 +264,21 @@ func (in *RotatingKeyList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RotatingKeyRef) DeepCopyInto(out *RotatingKeyRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RotatingKeyRef.
+func (in *RotatingKeyRef) DeepCopy() *RotatingKeyRef {
+	if in == nil {
+		return nil
+	}
+	out := new(RotatingKeyRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RotatingKeySpec) DeepCopyInto(out *RotatingKeySpec) {
 	*out = *in
@@ -198,7 +297,10 @@ func (in *RotatingKeySpec) DeepCopy() *RotatingKeySpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RotatingKeyStatus) DeepCopyInto(out *RotatingKeyStatus) {
 	*out = *in
-	in.NexRotation.DeepCopyInto(&out.NexRotation)
+	if in.NexRotation != nil {
+		in, out := &in.NexRotation, &out.NexRotation
+		*out = (*in).DeepCopy()
+	}
 	if in.VerificationKeys != nil {
 		in, out := &in.VerificationKeys, &out.VerificationKeys
 		*out = make([]ValidationKey, len(*in))
@@ -207,6 +309,13 @@ func (in *RotatingKeyStatus) DeepCopyInto(out *RotatingKeyStatus) {
 		}
 	}
 	out.SigningKey = in.SigningKey
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RotatingKeyStatus.
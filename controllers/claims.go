@@ -0,0 +1,280 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	rand2 "k8s.io/apimachinery/pkg/util/rand"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// Index keys of the Jwts by the config maps and secrets their claims are resolved from
+const configMapIndexKey = ".spec.claimsFrom.configMapKeyRef.name"
+const secretIndexKey = ".spec.claimsFrom.secretKeyRef.name"
+
+// claimsHashSecretKey holds the key of the claims hash in the secret of a Jwt
+const claimsHashSecretKey = "claims_hash_key"
+
+var metadataFieldPath = regexp.MustCompile(`^metadata\.(labels|annotations)\['(.+)'\]$`)
+
+func indexClaimSources(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &tokensv1alpha1.Jwt{}, configMapIndexKey, func(o runtime.Object) []string {
+		var names []string
+		for _, source := range o.(*tokensv1alpha1.Jwt).Spec.ClaimsFrom {
+			if source.ConfigMapKeyRef != nil {
+				names = append(names, source.ConfigMapKeyRef.Name)
+			}
+		}
+		return names
+	})
+	if err != nil {
+		return err
+	}
+
+	return mgr.GetFieldIndexer().IndexField(context.Background(), &tokensv1alpha1.Jwt{}, secretIndexKey, func(o runtime.Object) []string {
+		var names []string
+		for _, source := range o.(*tokensv1alpha1.Jwt).Spec.ClaimsFrom {
+			if source.SecretKeyRef != nil {
+				names = append(names, source.SecretKeyRef.Name)
+			}
+		}
+		return names
+	})
+}
+
+// claimSourceRequests maps a changed config map or secret to all Jwts
+// resolving claims from it.
+func (r *JwtReconciler) claimSourceRequests(indexKey string) handler.ToRequestsFunc {
+	return func(o handler.MapObject) []ctrl.Request {
+		return r.jwtRequests(
+			client.InNamespace(o.Meta.GetNamespace()),
+			client.MatchingFields{indexKey: o.Meta.GetName()})
+	}
+}
+
+// tokenClaims returns all claims of the token which stay the same between two
+// refreshes: custom claims, claims resolved from sources and the registered
+// claims sub, iss and aud.
+func (r *JwtReconciler) tokenClaims(ctx context.Context, jwt *tokensv1alpha1.Jwt, spec tokensv1alpha1.RotatingKeySpec) (jwtgo.MapClaims, error) {
+	claims := jwtgo.MapClaims{}
+
+	err := mergeCustomClaims(jwt, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range jwt.Spec.ClaimsFrom {
+		if tokensv1alpha1.ReservedClaims[source.Name] {
+			return nil, fmt.Errorf("claim %s is reserved", source.Name)
+		}
+
+		value, found, err := r.resolveClaimSource(ctx, jwt, source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve claim %s: %v", source.Name, err)
+		}
+		if found {
+			claims[source.Name] = value
+		}
+	}
+
+	claims["sub"] = jwt.Spec.Subject
+
+	if spec.Issuer != "" {
+		claims["iss"] = spec.Issuer
+	}
+
+	audiences := make([]string, len(jwt.Spec.Audiences))
+	for i, audience := range jwt.Spec.Audiences {
+		audiences[i] = string(audience)
+	}
+	// A single audience is set as plain string, as most verifiers expect
+	switch len(audiences) {
+	case 0:
+	case 1:
+		claims["aud"] = audiences[0]
+	default:
+		claims["aud"] = audiences
+	}
+
+	return claims, nil
+}
+
+// mergeCustomClaims adds the custom claims of the token spec to claims.
+// Reserved claims are rejected, as Jwts may be created without the
+// validating webhook.
+func mergeCustomClaims(jwt *tokensv1alpha1.Jwt, claims jwtgo.MapClaims) error {
+	if jwt.Spec.Claims == nil || len(jwt.Spec.Claims.Raw) == 0 {
+		return nil
+	}
+
+	// Numbers are kept as written, integers above 2^53 lose their precision
+	// as float64
+	custom := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(jwt.Spec.Claims.Raw))
+	decoder.UseNumber()
+	err := decoder.Decode(&custom)
+	if err != nil {
+		return fmt.Errorf("failed to decode custom claims: %v", err)
+	}
+
+	for k, v := range custom {
+		if tokensv1alpha1.ReservedClaims[k] {
+			return fmt.Errorf("claim %s is reserved", k)
+		}
+		claims[k] = v
+	}
+
+	return nil
+}
+
+// resolveClaimSource returns the value of a claim source. Missing optional
+// config maps and secrets are reported as not found instead of an error.
+func (r *JwtReconciler) resolveClaimSource(ctx context.Context, jwt *tokensv1alpha1.Jwt, source tokensv1alpha1.ClaimSource) (string, bool, error) {
+	switch {
+	case source.ConfigMapKeyRef != nil:
+		ref := source.ConfigMapKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+
+		configMap := &v1.ConfigMap{}
+		err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: jwt.Namespace}, configMap)
+		if err != nil {
+			if errors.IsNotFound(err) && optional {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+
+		value, ok := configMap.Data[ref.Key]
+		if !ok && !optional {
+			return "", false, fmt.Errorf("key %s not found in config map %s", ref.Key, ref.Name)
+		}
+		return value, ok, nil
+
+	case source.SecretKeyRef != nil:
+		ref := source.SecretKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+
+		secret := &v1.Secret{}
+		err := r.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: jwt.Namespace}, secret)
+		if err != nil {
+			if errors.IsNotFound(err) && optional {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+
+		value, ok := secret.Data[ref.Key]
+		if !ok && !optional {
+			return "", false, fmt.Errorf("key %s not found in secret %s", ref.Key, ref.Name)
+		}
+		return string(value), ok, nil
+
+	case source.FieldRef != nil:
+		return fieldRefValue(jwt, source.FieldRef.FieldPath)
+	}
+
+	return "", false, fmt.Errorf("no source set")
+}
+
+func fieldRefValue(jwt *tokensv1alpha1.Jwt, fieldPath string) (string, bool, error) {
+	switch fieldPath {
+	case "metadata.name":
+		return jwt.Name, true, nil
+	case "metadata.namespace":
+		return jwt.Namespace, true, nil
+	}
+
+	match := metadataFieldPath.FindStringSubmatch(fieldPath)
+	if match == nil {
+		return "", false, fmt.Errorf("unsupported field path %s", fieldPath)
+	}
+
+	values := jwt.Labels
+	if match[1] == "annotations" {
+		values = jwt.Annotations
+	}
+
+	value, ok := values[match[2]]
+	return value, ok, nil
+}
+
+// issueClaims returns a copy of claims with the time dependent registered
+// claims (RFC 7519, section 4.1) of a token issued at issuedAt. The expiry
+// matches the lifetime of the Jwt, so the token and the ExpiresAt status
+// field agree.
+func issueClaims(claims jwtgo.MapClaims, issuedAt time.Time, lifetime time.Duration) jwtgo.MapClaims {
+	issued := jwtgo.MapClaims{}
+	for k, v := range claims {
+		issued[k] = v
+	}
+
+	issued["iat"] = issuedAt.Unix()
+	issued["nbf"] = issuedAt.Unix()
+	issued["exp"] = issuedAt.Add(lifetime).Unix()
+	issued["jti"] = rand2.String(20)
+
+	return issued
+}
+
+// claimsHash returns a stable hash of claims, used to detect when a token
+// has to be re-issued. Claims may be resolved from secrets, so the hash is
+// keyed and does not allow to guess their values from the Jwt status.
+func claimsHash(claims jwtgo.MapClaims, key string) (string, error) {
+	// Map keys are sorted when encoded, so equal claims result in the same hash
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(encoded)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// claimsHashKey returns the key of the claims hash stored in the secret of a
+// Jwt, or a new random key for secrets without one. The key is only readable
+// with the token, which contains the claims anyway.
+func claimsHashKey(secret *v1.Secret) (string, error) {
+	if key := secret.Data[claimsHashSecretKey]; len(key) > 0 {
+		return string(key), nil
+	}
+
+	key := make([]byte, sha256.Size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
@@ -0,0 +1,128 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestClaimsHashIsKeyed(t *testing.T) {
+	claims := jwtgo.MapClaims{"sub": "subject", "password": "secret"}
+
+	key, err := claimsHashKey(&v1.Secret{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := claimsHash(claims, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, _ := json.Marshal(claims)
+	sum := sha256.Sum256(encoded)
+	if hash == hex.EncodeToString(sum[:]) {
+		t.Error("claims hash is the plain hash of the claims")
+	}
+
+	again, _ := claimsHash(jwtgo.MapClaims{"password": "secret", "sub": "subject"}, key)
+	if again != hash {
+		t.Errorf("hash of equal claims changed: %s != %s", again, hash)
+	}
+
+	otherKey, err := claimsHashKey(&v1.Secret{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherKey == key {
+		t.Error("new claims hash keys are equal")
+	}
+	other, _ := claimsHash(claims, otherKey)
+	if other == hash {
+		t.Error("hash does not depend on the key")
+	}
+}
+
+func TestClaimsHashKeyFromSecret(t *testing.T) {
+	secret := &v1.Secret{Data: map[string][]byte{claimsHashSecretKey: []byte("stored")}}
+
+	key, err := claimsHashKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "stored" {
+		t.Errorf("got key %q, want the stored key", key)
+	}
+}
+
+func TestTokenClaimsRejectsReservedSources(t *testing.T) {
+	r := &JwtReconciler{}
+	for claim := range tokensv1alpha1.ReservedClaims {
+		jwt := &tokensv1alpha1.Jwt{}
+		jwt.Spec.ClaimsFrom = []tokensv1alpha1.ClaimSource{{
+			Name:     claim,
+			FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		}}
+
+		_, err := r.tokenClaims(context.Background(), jwt, tokensv1alpha1.RotatingKeySpec{})
+		if err == nil {
+			t.Errorf("claim %s from a source was accepted", claim)
+		}
+	}
+}
+
+func TestMergeCustomClaims(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    jwtgo.MapClaims
+		wantErr bool
+	}{
+		{name: "none", raw: "", want: jwtgo.MapClaims{}},
+		{name: "custom", raw: `{"role":"reader","groups":["a"]}`, want: jwtgo.MapClaims{"role": "reader", "groups": []interface{}{"a"}}},
+		{name: "large integer", raw: `{"id":9007199254740993}`, want: jwtgo.MapClaims{"id": json.Number("9007199254740993")}},
+		{name: "reserved", raw: `{"role":"reader","sub":"admin"}`, wantErr: true},
+		{name: "not an object", raw: `["role"]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwt := &tokensv1alpha1.Jwt{}
+			if tt.raw != "" {
+				jwt.Spec.Claims = &runtime.RawExtension{Raw: []byte(tt.raw)}
+			}
+
+			claims := jwtgo.MapClaims{}
+			err := mergeCustomClaims(jwt, claims)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(claims, tt.want) {
+				t.Errorf("got claims %v, want %v", claims, tt.want)
+			}
+		})
+	}
+}
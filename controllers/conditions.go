@@ -0,0 +1,49 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// setCondition sets the condition for the generation of the object.
+func setCondition(conditions *[]tokensv1alpha1.Condition, generation int64, conditionType tokensv1alpha1.ConditionType, status bool, reason, message string) {
+	conditionStatus := v1.ConditionFalse
+	if status {
+		conditionStatus = v1.ConditionTrue
+	}
+
+	tokensv1alpha1.SetCondition(conditions, tokensv1alpha1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setFailedConditions marks the object as degraded and the failed condition
+// and the object as not ready. Failures passed as degraded only keep the
+// object usable with its last state.
+func setFailedConditions(conditions *[]tokensv1alpha1.Condition, generation int64, failed tokensv1alpha1.ConditionType, reason, message string) {
+	if failed != tokensv1alpha1.ConditionDegraded {
+		setCondition(conditions, generation, failed, false, reason, message)
+		setCondition(conditions, generation, tokensv1alpha1.ConditionReady, false, reason, message)
+	}
+	setCondition(conditions, generation, tokensv1alpha1.ConditionDegraded, true, reason, message)
+}
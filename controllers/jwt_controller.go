@@ -18,17 +18,22 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	jwtgo "github.com/dgrijalva/jwt-go"
 	"github.com/go-logr/logr"
 	"github.com/hexhibit-xyz/toope/crypto"
+	"hash/fnv"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"time"
 
 	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
@@ -37,11 +42,19 @@ import (
 var defaultLabels = map[string]string{
 	"tokator.hexhibit.xyz/controlled": "true"}
 
+// TokenSecretKey holds the signed token in the secret of a Jwt
+const TokenSecretKey = "token"
+
+// Index key of the Jwts by the namespaced name of their RotatingKey
+const rotatingKeyIndexKey = ".spec.rotatingKeyRef"
+
 // JwtReconciler reconciles a Jwt object
 type JwtReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Backends KeyBackends
+	Recorder record.EventRecorder
 }
 
 type Logger struct {
@@ -53,9 +66,27 @@ func (l Logger) errResult(err error, msg string) (ctrl.Result, error) {
 	return ctrl.Result{}, err
 }
 
+// updateErrResult requeues a reconcile which worked on a stale object, as its
+// write lost against a newer version. All other errors are reported.
+func (l Logger) updateErrResult(err error, msg string) (ctrl.Result, error) {
+	if staleWrite(err) {
+		l.Info(msg+", object changed in the meantime", "reason", err.Error())
+		return ctrl.Result{Requeue: true}, nil
+	}
+	return l.errResult(err, msg)
+}
+
+// staleWrite reports whether a write failed as the object changed since it
+// was read
+func staleWrite(err error) bool {
+	return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+}
+
 // +kubebuilder:rbac:groups=tokens.hexhibit.xyz,resources=jwts,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tokens.hexhibit.xyz,resources=jwts/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;update;patch;watch;list;delete;create
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 func (r *JwtReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
@@ -69,80 +100,285 @@ func (r *JwtReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	if err != nil {
 		if errors.IsNotFound(err) {
 			//Requested Object not found
+			jwtExpirySeconds.Delete(req.NamespacedName)
 			return log.errResult(err, "requested object not found, might be deleted")
 		}
 		return log.errResult(err, "")
 	}
 
 	rotatingKey := &tokensv1alpha1.RotatingKey{}
-	err = r.Client.Get(ctx, req.NamespacedName, rotatingKey)
+	err = r.Client.Get(ctx, rotatingKeyName(token), rotatingKey)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			//Requested Object not found
-			return log.errResult(err, "requested rotatingKey object not found, might be deleted")
+			return r.failed(ctx, log, token, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyNotFound, err, "requested rotatingKey object not found, might be deleted")
 		}
 		return log.errResult(err, "")
 	}
+	// Keys created without the defaulting webhook
+	rotatingKey.Default()
+
+	if !rotatingKey.AllowsNamespace(token.Namespace) {
+		err = fmt.Errorf("rotating key %s/%s does not allow namespace %s", rotatingKey.Namespace, rotatingKey.Name, token.Namespace)
+		return r.failed(ctx, log, token, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonNamespaceNotAllowed, err, "rotating key not allowed")
+	}
+
+	claims, err := r.tokenClaims(ctx, token, rotatingKey.Spec)
+	if err != nil {
+		return r.failed(ctx, log, token, tokensv1alpha1.ConditionSigned, tokensv1alpha1.ReasonClaimsUnresolved, err, "failed to resolve claims")
+	}
+
+	timing, err := newTokenTiming(token, rotatingKey)
+	if err != nil {
+		return r.failed(ctx, log, token, tokensv1alpha1.ConditionSigned, tokensv1alpha1.ReasonInvalidLifetime, err, "invalid token lifetime")
+	}
+
+	privateKey := &v1.Secret{}
+	err = r.Client.Get(ctx, types.NamespacedName{Name: rotatingKey.Name, Namespace: rotatingKey.Namespace}, privateKey)
+	if err != nil {
+		return r.failed(ctx, log, token, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyUnavailable, err, "failed to get private key secret")
+	}
+
+	provider, err := keyProvider(r.Backends, rotatingKey, privateKey)
+	if err != nil {
+		return r.failed(ctx, log, token, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonBackendUnavailable, err, "failed to create key provider")
+	}
+
+	// The secret of the rotating key is ahead of its status after a rotation
+	keys, err := storedKeyIDs(rotatingKey, privateKey)
+	if err != nil {
+		return r.failed(ctx, log, token, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyUnavailable, err, "failed to decode key state")
+	}
+
+	// Reason of the Signed condition, kept if the token is not re-signed
+	signedReason := tokensv1alpha1.ReasonTokenValid
+	if c := tokensv1alpha1.FindCondition(token.Status.Conditions, tokensv1alpha1.ConditionSigned); c != nil && c.Status == v1.ConditionTrue {
+		signedReason = c.Reason
+	}
 
 	secret := &v1.Secret{}
 	err = r.Client.Get(ctx, types.NamespacedName{Name: token.Name, Namespace: token.Namespace}, secret)
-	if err != nil && errors.IsNotFound(err) {
+	if err != nil && !errors.IsNotFound(err) {
+		return log.errResult(err, "failed to get secret")
+	}
+	found := err == nil
+
+	hashKey, err := claimsHashKey(secret)
+	if err != nil {
+		return log.errResult(err, "failed to create claims hash key")
+	}
+	hash, err := claimsHash(claims, hashKey)
+	if err != nil {
+		return log.errResult(err, "failed to hash claims")
+	}
 
-		privateKey := &v1.Secret{}
-		err := r.Client.Get(ctx, types.NamespacedName{Name: rotatingKey.Name, Namespace: rotatingKey.Namespace}, privateKey)
+	if !found {
+		issuedAt := metav1.NewTime(time.Now().Truncate(time.Second))
+		var kid string
+		secret, kid, err = generateSecret(token, rotatingKey, provider, privateKey, claims, issuedAt.Time, timing.lifetime)
 		if err != nil {
-			return log.errResult(err, "failed to get private key secret")
+			return r.failed(ctx, log, token, tokensv1alpha1.ConditionSigned, tokensv1alpha1.ReasonSigningFailed, err, "failed to sign token")
 		}
+		secret.StringData[claimsHashSecretKey] = hashKey
+		token.Status.LastRefresh = &issuedAt
+		token.Status.ClaimsHash = hash
+		token.Status.KeyID = kid
 
-		secret, err = generateSecret(token, rotatingKey.Spec, privateKey)
+		err = controllerutil.SetControllerReference(token, secret, r.Scheme)
 		if err != nil {
-			return log.errResult(err, "failed to generate secret")
+			return log.errResult(err, "failed to set token controller reference")
 		}
 
 		err = r.Client.Create(context.Background(), secret, &client.CreateOptions{})
-		if err != nil {
-			return log.errResult(err, "failed to create secret")
+		if staleWrite(err) {
+			return log.updateErrResult(err, "failed to create secret")
+		} else if err != nil {
+			return r.failed(ctx, log, token, tokensv1alpha1.ConditionSigned, tokensv1alpha1.ReasonUpdateFailed, err, "failed to create secret")
 		}
+		resignsTotal.WithLabelValues(token.Namespace, refreshIssued).Inc()
+		signedReason = tokensv1alpha1.ReasonTokenIssued
+		r.Recorder.Eventf(token, v1.EventTypeNormal, signedReason, "Issued token signed with key %s", kid)
 
-	} else if err != nil {
-		return log.errResult(err, "failed to get secret")
-	}
+	} else if reason := refreshReason(token, keys, hash, timing.lifetime); reason != "" {
+		log.Info("token is expired, claims or key changed, try to refresh", "reason", reason)
 
-	now := metav1.Now()
-	if token.Status.Expired || token.Status.ExpiresAt.Before(&now) || token.Status.RefreshAfter.Before(&now) {
-		log.Info("token is expired, try to refresh")
-		updateSecret(*token, secret)
+		issuedAt := metav1.NewTime(time.Now().Truncate(time.Second))
+		kid, err := updateSecret(rotatingKey, provider, privateKey, claims, issuedAt.Time, timing.lifetime, secret)
+		if err != nil {
+			return r.failed(ctx, log, token, tokensv1alpha1.ConditionSigned, tokensv1alpha1.ReasonSigningFailed, err, "failed to sign token")
+		}
+		// Secrets issued before the hash was keyed get a key with the refresh
+		secret.StringData[claimsHashSecretKey] = hashKey
 
 		log.Info("update secret")
-		err = r.Client.Update(context.TODO(), secret, &client.UpdateOptions{})
-		if err != nil {
-			return log.errResult(err, "failed to update secret")
+		err = r.Client.Update(ctx, secret, &client.UpdateOptions{})
+		if staleWrite(err) {
+			return log.updateErrResult(err, "failed to update secret")
+		} else if err != nil {
+			return r.failed(ctx, log, token, tokensv1alpha1.ConditionSigned, tokensv1alpha1.ReasonUpdateFailed, err, "failed to update secret")
 		}
+		token.Status.LastRefresh = &issuedAt
+		token.Status.ClaimsHash = hash
+		token.Status.KeyID = kid
 
+		resignsTotal.WithLabelValues(token.Namespace, reason).Inc()
+		signedReason = tokensv1alpha1.ReasonTokenRefreshed
+		r.Recorder.Eventf(token, v1.EventTypeNormal, signedReason, "Refreshed token signed with key %s", kid)
 	}
 
-	lifetime, err := time.ParseDuration(rotatingKey.Spec.Lifetime)
-	if err != nil {
-		return log.errResult(err, "failed to parse lifetime")
-	}
+	updateRefreshStatus(token, timing, rotatingKey.Spec.Algorithm)
 
-	updateRefreshStatus(token, lifetime, rotatingKey.Spec.Algorithm)
+	generation := token.Generation
+	token.Status.ObservedGeneration = generation
+	setCondition(&token.Status.Conditions, generation, tokensv1alpha1.ConditionKeyAvailable, true, tokensv1alpha1.ReasonKeyLoaded,
+		fmt.Sprintf("Signing key of rotating key %s/%s is available", rotatingKey.Namespace, rotatingKey.Name))
+	setCondition(&token.Status.Conditions, generation, tokensv1alpha1.ConditionSigned, true, signedReason,
+		fmt.Sprintf("Token is signed with key %s", token.Status.KeyID))
+	setCondition(&token.Status.Conditions, generation, tokensv1alpha1.ConditionReady, true, tokensv1alpha1.ReasonTokenValid,
+		fmt.Sprintf("Token is valid until %s", token.Status.ExpiresAt.UTC().Format(time.RFC3339)))
+	setCondition(&token.Status.Conditions, generation, tokensv1alpha1.ConditionDegraded, false, tokensv1alpha1.ReasonReconciled, "")
 
 	log.Info("update token")
 	err = r.Status().Update(ctx, token)
 	if err != nil {
-		return log.errResult(err, "failed to update token")
+		if !staleWrite(err) {
+			r.Recorder.Eventf(token, v1.EventTypeWarning, tokensv1alpha1.ReasonUpdateFailed, "failed to update token status: %v", err)
+		}
+		return log.updateErrResult(err, "failed to update token")
 	}
+	jwtExpirySeconds.Set(req.NamespacedName, token.Status.ExpiresAt.Time)
+
+	return ctrl.Result{RequeueAfter: token.Status.NextReconcile.Sub(time.Now())}, nil
+}
+
+// rotatingKeyName returns the name of the referenced RotatingKey, defaulting
+// the namespace to the namespace of the token.
+func rotatingKeyName(token *tokensv1alpha1.Jwt) types.NamespacedName {
+	namespace := token.Spec.RotatingKeyRef.Namespace
+	if namespace == "" {
+		namespace = token.Namespace
+	}
+	return types.NamespacedName{Name: token.Spec.RotatingKeyRef.Name, Namespace: namespace}
+}
+
+// failed marks the token as not ready and records the error in its status
+// and as event, so a failed refresh is visible without reading the
+// controller logs. The reason is set on the failed condition.
+func (r *JwtReconciler) failed(ctx context.Context, log Logger, token *tokensv1alpha1.Jwt, failed tokensv1alpha1.ConditionType, reason string, err error, msg string) (ctrl.Result, error) {
+	token.Status.Ready = false
+	token.Status.Error = err.Error()
+	now := metav1.Now()
+	token.Status.LastTransitionTime = &now
+	token.Status.ObservedGeneration = token.Generation
+	setFailedConditions(&token.Status.Conditions, token.Generation, failed, reason, err.Error())
+	issueFailuresTotal.WithLabelValues(token.Namespace, reason).Inc()
+
+	r.Recorder.Eventf(token, v1.EventTypeWarning, reason, "%s: %v", msg, err)
+
+	statusErr := r.Status().Update(ctx, token)
+	if statusErr != nil {
+		r.Recorder.Eventf(token, v1.EventTypeWarning, tokensv1alpha1.ReasonUpdateFailed, "failed to update token status: %v", statusErr)
+		log.Error(statusErr, "failed to update token")
+	}
+
+	return log.errResult(err, msg)
+}
+
+// keyIDs are the key IDs of a rotating key
+type keyIDs struct {
+	signing      string
+	verification map[string]bool
+}
 
-	err = controllerutil.SetControllerReference(token, secret, r.Scheme)
+// storedKeyIDs returns the key IDs stored in the secret of the rotating key.
+// The kid of a token is compared against the secret, as the status of the
+// rotating key lags behind after a rotation.
+func storedKeyIDs(rotatingKey *tokensv1alpha1.RotatingKey, privateKey *v1.Secret) (keyIDs, error) {
+	state, err := loadKeyState(rotatingKey, privateKey)
 	if err != nil {
-		return log.errResult(err, "failed to set token controller reference")
+		return keyIDs{}, err
 	}
 
-	return ctrl.Result{RequeueAfter: token.Status.NextReconcile.Sub(time.Now())}, nil
+	keys := keyIDs{
+		signing:      crypto.KidFromSecret(privateKey),
+		verification: map[string]bool{},
+	}
+	if keys.signing == "" {
+		keys.signing = rotatingKey.Status.SigningKey.KeyID
+	}
+	for _, k := range state.VerificationKeys {
+		keys.verification[k.KeyID] = true
+	}
+	return keys, nil
 }
 
-func updateRefreshStatus(token *tokensv1alpha1.Jwt, lifetime time.Duration, algorithm string) {
+// refreshReason returns why the token has to be re-issued, empty if the
+// token is up to date.
+func refreshReason(token *tokensv1alpha1.Jwt, keys keyIDs, claimsHash string, lifetime time.Duration) string {
+	now := metav1.Now()
+	if token.Status.ClaimsHash != claimsHash {
+		return refreshClaims
+	}
+	if token.Status.Lifetime != "" && token.Status.Lifetime != lifetime.String() {
+		return refreshLifetime
+	}
+	if token.Status.Expired || token.Status.ExpiresAt == nil ||
+		token.Status.ExpiresAt.Before(&now) ||
+		token.Status.RefreshAfter.Before(&now) {
+		return refreshExpiry
+	}
+
+	kid := token.Status.KeyID
+	if kid == "" || kid == keys.signing {
+		return ""
+	}
+
+	// The key rotated, a token signed with a key which can not be
+	// verified anymore is re-issued regardless of the policy
+	if !keys.verification[kid] {
+		return refreshRevoked
+	}
+	if token.Spec.ReissueOnRotation == tokensv1alpha1.ReissueLazy {
+		return ""
+	}
+	return refreshRotation
+}
+
+// tokenTiming holds when a token expires and is refreshed
+type tokenTiming struct {
+	lifetime      time.Duration
+	refreshBefore time.Duration
+	jitter        time.Duration
+}
+
+// newTokenTiming returns the timing of the Jwt signed with the rotating key.
+func newTokenTiming(token *tokensv1alpha1.Jwt, rotatingKey *tokensv1alpha1.RotatingKey) (tokenTiming, error) {
+	t := tokenTiming{}
+	var err error
+	t.lifetime, t.refreshBefore, t.jitter, err = token.Timing(rotatingKey.Spec)
+	return t, err
+}
+
+// jitterDelay returns the part of the jitter applied to a token issued at
+// issuedAt. It is derived from the token, so every reconcile computes the
+// same refresh time.
+func jitterDelay(token *tokensv1alpha1.Jwt, issuedAt time.Time, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%s/%s/%d", token.Namespace, token.Name, issuedAt.Unix())
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
+
+// timePtr returns t as time of an optional status field
+func timePtr(t time.Time) *metav1.Time {
+	mt := metav1.NewTime(t)
+	return &mt
+}
+
+func updateRefreshStatus(token *tokensv1alpha1.Jwt, timing tokenTiming, algorithm string) {
 
 	now := metav1.Now()
 	creationDate := now
@@ -150,36 +386,85 @@ func updateRefreshStatus(token *tokensv1alpha1.Jwt, lifetime time.Duration, algo
 		creationDate = *token.Status.LastRefresh
 	}
 
-	expAt := creationDate.Add(lifetime)
-	refAfter := creationDate.Add(lifetime * 7 / 10.0)
-	nextReconcile := creationDate.Add(lifetime * 8 / 10.0)
+	expAt := creationDate.Add(timing.lifetime)
+	refAfter := expAt.Add(-timing.refreshBefore - jitterDelay(token, creationDate.Time, timing.jitter))
+	// The token is re-issued by the reconcile at its refresh time
+	nextReconcile := refAfter
+
+	token.Status.Algorithm = algorithm
+	token.Status.Lifetime = timing.lifetime.String()
+	token.Status.Expired = false
+	token.Status.ExpiresAt = timePtr(expAt)
+	token.Status.RefreshAfter = timePtr(refAfter)
+	token.Status.NextReconcile = timePtr(nextReconcile)
+	token.Status.LastTransitionTime = &now
+	token.Status.Ready = true
+	token.Status.Error = ""
+}
+
+// issueToken signs claims with the private key of the rotating key, loaded by
+// the provider of its backend, and returns the token with the key ID of the
+// private key. The time dependent registered claims are set relative to
+// issuedAt.
+func issueToken(rotatingKey *tokensv1alpha1.RotatingKey, provider crypto.KeyProvider, privateKey *v1.Secret, claims jwtgo.MapClaims, issuedAt time.Time, lifetime time.Duration) (string, string, error) {
+
+	signer, err := provider.FromSecret(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	kid, err := signingKid(rotatingKey, privateKey, signer)
+	if err != nil {
+		return "", "", err
+	}
+
+	a := &jwtgo.Token{
+		Header: map[string]interface{}{
+			"typ": "JWT",
+			"alg": signer.Algorithm(),
+			"kid": kid,
+		},
+		Claims: issueClaims(claims, issuedAt, lifetime),
+	}
 
-	token.Status = tokensv1alpha1.JwtStatus{
-		Algorithm:          algorithm,
-		Lifetime:           algorithm,
-		Expired:            false,
-		ExpiresAt:          metav1.NewTime(expAt),
-		RefreshAfter:       metav1.NewTime(refAfter),
-		NextReconcile:      metav1.NewTime(nextReconcile),
-		LastTransitionTime: now,
-		Ready:              true,
+	backend := rotatingKey.Spec.Backend
+	if backend == "" {
+		backend = tokensv1alpha1.KeyBackendLocal
 	}
+
+	start := time.Now()
+	signed, err := crypto.SignToken(signer, a)
+	signingDuration.WithLabelValues(signer.Algorithm(), string(backend)).Observe(time.Since(start).Seconds())
+	return signed, kid, err
 }
 
-func generateSecret(jwt *tokensv1alpha1.Jwt, spec tokensv1alpha1.RotatingKeySpec, privateKey *v1.Secret) (secret *v1.Secret, err error) {
+// signingKid returns the key ID of the private key. The key ID is stored next
+// to the private key, for older secrets the status is only trusted if its
+// public key belongs to the private key.
+func signingKid(rotatingKey *tokensv1alpha1.RotatingKey, privateKey *v1.Secret, signer crypto.Signer) (string, error) {
+	kid := crypto.KidFromSecret(privateKey)
+	if kid != "" {
+		return kid, nil
+	}
 
-	private, err := crypto.FromSecret(privateKey)
+	public, err := crypto.DecodePublic(signer.Public())
 	if err != nil {
-		return
+		return "", err
+	}
+
+	signingKey := rotatingKey.Status.SigningKey
+	if signingKey.KeyID == "" || signingKey.PublicKey != public {
+		return "", fmt.Errorf("no key id found for the private key of %s", rotatingKey.Name)
 	}
 
-	signingMethod := jwtgo.GetSigningMethod(spec.Algorithm)
+	return signingKey.KeyID, nil
+}
 
-	a := jwtgo.NewWithClaims(signingMethod, jwtgo.MapClaims{})
+func generateSecret(jwt *tokensv1alpha1.Jwt, rotatingKey *tokensv1alpha1.RotatingKey, provider crypto.KeyProvider, privateKey *v1.Secret, claims jwtgo.MapClaims, issuedAt time.Time, lifetime time.Duration) (secret *v1.Secret, kid string, err error) {
 
-	token, err := a.SignedString(private)
+	token, kid, err := issueToken(rotatingKey, provider, privateKey, claims, issuedAt, lifetime)
 	if err != nil {
-		return secret, err
+		return secret, "", err
 	}
 
 	return &v1.Secret{
@@ -190,20 +475,69 @@ func generateSecret(jwt *tokensv1alpha1.Jwt, spec tokensv1alpha1.RotatingKeySpec
 		},
 		Immutable:  nil,
 		Data:       nil,
-		StringData: map[string]string{"token": token},
+		StringData: map[string]string{TokenSecretKey: token},
 		Type:       "Opaque",
-	}, nil
+	}, kid, nil
 }
 
-func updateSecret(jwt tokensv1alpha1.Jwt, secret *v1.Secret) {
-	a := jwtgo.New(jwtgo.SigningMethodES256)
-	token, _ := a.SignedString([]byte("YOLOLOLO"))
-	secret.StringData = map[string]string{"token": token}
+// updateSecret re-signs the token of an existing secret, using the same
+// signing path as generateSecret.
+func updateSecret(rotatingKey *tokensv1alpha1.RotatingKey, provider crypto.KeyProvider, privateKey *v1.Secret, claims jwtgo.MapClaims, issuedAt time.Time, lifetime time.Duration, secret *v1.Secret) (string, error) {
+	token, kid, err := issueToken(rotatingKey, provider, privateKey, claims, issuedAt, lifetime)
+	if err != nil {
+		return "", err
+	}
+
+	secret.StringData = map[string]string{TokenSecretKey: token}
+	return kid, nil
+}
+
+// jwtRequests returns a request for every Jwt matching the list options.
+func (r *JwtReconciler) jwtRequests(opts ...client.ListOption) []ctrl.Request {
+	tokens := &tokensv1alpha1.JwtList{}
+	err := r.List(context.Background(), tokens, opts...)
+	if err != nil {
+		r.Log.Error(err, "failed to list jwts")
+		return nil
+	}
+
+	requests := make([]ctrl.Request, len(tokens.Items))
+	for i, t := range tokens.Items {
+		requests[i] = ctrl.Request{NamespacedName: types.NamespacedName{Name: t.Name, Namespace: t.Namespace}}
+	}
+	return requests
+}
+
+// rotatingKeyRequests maps a rotated or revoked RotatingKey to all Jwts signed with it.
+func (r *JwtReconciler) rotatingKeyRequests(o handler.MapObject) []ctrl.Request {
+	name := types.NamespacedName{Name: o.Meta.GetName(), Namespace: o.Meta.GetNamespace()}
+	return r.jwtRequests(client.MatchingFields{rotatingKeyIndexKey: name.String()})
 }
 
 func (r *JwtReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := indexClaimSources(mgr)
+	if err != nil {
+		return err
+	}
+
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &tokensv1alpha1.Jwt{}, rotatingKeyIndexKey, func(o runtime.Object) []string {
+		return []string{rotatingKeyName(o.(*tokensv1alpha1.Jwt)).String()}
+	})
+	if err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&tokensv1alpha1.Jwt{}).
 		Owns(&v1.Secret{}).
+		Watches(&source.Kind{Type: &v1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.claimSourceRequests(configMapIndexKey),
+		}).
+		Watches(&source.Kind{Type: &v1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.claimSourceRequests(secretIndexKey),
+		}).
+		Watches(&source.Kind{Type: &tokensv1alpha1.RotatingKey{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.rotatingKeyRequests),
+		}).
 		Complete(r)
 }
@@ -0,0 +1,223 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	"github.com/hexhibit-xyz/toope/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestRefreshReason(t *testing.T) {
+	now := time.Now()
+	keys := keyIDs{signing: "signing", verification: map[string]bool{"rotated": true}}
+
+	valid := tokensv1alpha1.JwtStatus{
+		ClaimsHash:   "hash",
+		Lifetime:     time.Hour.String(),
+		KeyID:        "signing",
+		ExpiresAt:    timePtr(now.Add(time.Hour)),
+		RefreshAfter: timePtr(now.Add(30 * time.Minute)),
+	}
+
+	tests := []struct {
+		name   string
+		status func(*tokensv1alpha1.JwtStatus)
+		policy tokensv1alpha1.ReissuePolicy
+		want   string
+	}{
+		{name: "valid", want: ""},
+		{name: "claims changed", status: func(s *tokensv1alpha1.JwtStatus) { s.ClaimsHash = "other" }, want: refreshClaims},
+		{name: "lifetime changed", status: func(s *tokensv1alpha1.JwtStatus) { s.Lifetime = "2h0m0s" }, want: refreshLifetime},
+		{name: "lifetime unknown", status: func(s *tokensv1alpha1.JwtStatus) { s.Lifetime = "" }, want: ""},
+		{name: "expired", status: func(s *tokensv1alpha1.JwtStatus) { s.Expired = true }, want: refreshExpiry},
+		{name: "expires in the past", status: func(s *tokensv1alpha1.JwtStatus) { s.ExpiresAt = timePtr(now.Add(-time.Minute)) }, want: refreshExpiry},
+		{name: "refresh due", status: func(s *tokensv1alpha1.JwtStatus) { s.RefreshAfter = timePtr(now.Add(-time.Minute)) }, want: refreshExpiry},
+		{name: "no key id", status: func(s *tokensv1alpha1.JwtStatus) { s.KeyID = "" }, want: ""},
+		{name: "rotated", status: func(s *tokensv1alpha1.JwtStatus) { s.KeyID = "rotated" }, want: refreshRotation},
+		{name: "rotated lazy", status: func(s *tokensv1alpha1.JwtStatus) { s.KeyID = "rotated" }, policy: tokensv1alpha1.ReissueLazy, want: ""},
+		{name: "revoked", status: func(s *tokensv1alpha1.JwtStatus) { s.KeyID = "revoked" }, want: refreshRevoked},
+		{name: "revoked lazy", status: func(s *tokensv1alpha1.JwtStatus) { s.KeyID = "revoked" }, policy: tokensv1alpha1.ReissueLazy, want: refreshRevoked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &tokensv1alpha1.Jwt{
+				Spec:   tokensv1alpha1.JwtSpec{ReissueOnRotation: tt.policy},
+				Status: valid,
+			}
+			if tt.status != nil {
+				tt.status(&token.Status)
+			}
+
+			got := refreshReason(token, keys, "hash", time.Hour)
+			if got != tt.want {
+				t.Errorf("refreshReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A token signed with the key of a rotation, which is stored in the secret but
+// not yet in the status of the rotating key, is up to date.
+func TestStoredKeyIDsAheadOfStatus(t *testing.T) {
+	rotatingKey := &tokensv1alpha1.RotatingKey{
+		Status: tokensv1alpha1.RotatingKeyStatus{
+			SigningKey: tokensv1alpha1.SigningKey{KeyID: "old"},
+		},
+	}
+
+	state, err := json.Marshal(keyState{
+		VerificationKeys: []tokensv1alpha1.ValidationKey{{KeyID: "old"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := &v1.Secret{Data: map[string][]byte{
+		crypto.SecretKeyKid: []byte("new"),
+		secretKeyState:      state,
+	}}
+
+	keys, err := storedKeyIDs(rotatingKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := &tokensv1alpha1.Jwt{Status: tokensv1alpha1.JwtStatus{
+		ClaimsHash: "hash",
+		KeyID:      "new",
+		ExpiresAt:  timePtr(time.Now().Add(time.Hour)),
+	}}
+	token.Status.RefreshAfter = token.Status.ExpiresAt
+	if reason := refreshReason(token, keys, "hash", time.Hour); reason != "" {
+		t.Errorf("token signed with the stored key is refreshed: %s", reason)
+	}
+
+	token.Status.KeyID = "old"
+	if reason := refreshReason(token, keys, "hash", time.Hour); reason != refreshRotation {
+		t.Errorf("token signed with the rotated key: got %q, want %q", reason, refreshRotation)
+	}
+}
+
+func TestJitterDelay(t *testing.T) {
+	issuedAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	token := func(name string) *tokensv1alpha1.Jwt {
+		return &tokensv1alpha1.Jwt{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		issuedAt time.Time
+		jitter   time.Duration
+	}{
+		{name: "disabled", token: "a", issuedAt: issuedAt},
+		{name: "negative", token: "a", issuedAt: issuedAt, jitter: -time.Minute},
+		{name: "jitter", token: "a", issuedAt: issuedAt, jitter: 10 * time.Minute},
+		{name: "other token", token: "b", issuedAt: issuedAt, jitter: 10 * time.Minute},
+		{name: "reissued", token: "a", issuedAt: issuedAt.Add(time.Hour), jitter: 10 * time.Minute},
+		{name: "short jitter", token: "a", issuedAt: issuedAt, jitter: time.Nanosecond},
+	}
+
+	delays := map[time.Duration]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := jitterDelay(token(tt.token), tt.issuedAt, tt.jitter)
+			if tt.jitter <= 0 {
+				if delay != 0 {
+					t.Errorf("got delay %s without jitter", delay)
+				}
+				return
+			}
+			if delay < 0 || delay >= tt.jitter {
+				t.Errorf("got delay %s, want within [0, %s)", delay, tt.jitter)
+			}
+			if again := jitterDelay(token(tt.token), tt.issuedAt, tt.jitter); again != delay {
+				t.Errorf("delay changed between calls: %s != %s", again, delay)
+			}
+			if tt.jitter > time.Nanosecond {
+				delays[delay] = true
+			}
+		})
+	}
+
+	// Tokens and their re-issues are spread over the jitter
+	if len(delays) != 3 {
+		t.Errorf("got %d distinct delays for 3 tokens: %v", len(delays), delays)
+	}
+}
+
+func TestUpdateRefreshStatus(t *testing.T) {
+	lastRefresh := metav1.NewTime(time.Now().Truncate(time.Second))
+	timing := tokenTiming{lifetime: time.Hour, refreshBefore: 12 * time.Minute, jitter: 6 * time.Minute}
+
+	token := &tokensv1alpha1.Jwt{
+		ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+		Status:     tokensv1alpha1.JwtStatus{LastRefresh: &lastRefresh, Expired: true},
+	}
+	updateRefreshStatus(token, timing, "RS256")
+
+	expiresAt := lastRefresh.Add(time.Hour)
+	refreshAfter := expiresAt.Add(-12*time.Minute - jitterDelay(token, lastRefresh.Time, timing.jitter))
+	if !token.Status.ExpiresAt.Time.Equal(expiresAt) {
+		t.Errorf("got expiresAt %s, want %s", token.Status.ExpiresAt, expiresAt)
+	}
+	if !token.Status.RefreshAfter.Time.Equal(refreshAfter) {
+		t.Errorf("got refreshAfter %s, want %s", token.Status.RefreshAfter, refreshAfter)
+	}
+	if !token.Status.NextReconcile.Time.Equal(refreshAfter) {
+		t.Errorf("got nextReconcile %s, want the refresh time %s", token.Status.NextReconcile, refreshAfter)
+	}
+	if token.Status.Expired || token.Status.Lifetime != "1h0m0s" || token.Status.Algorithm != "RS256" {
+		t.Errorf("got status %+v", token.Status)
+	}
+}
+
+func TestFailedIssueIsCountedByReason(t *testing.T) {
+	token := &tokensv1alpha1.Jwt{
+		ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "failures"},
+		Spec: tokensv1alpha1.JwtSpec{
+			Subject:        "subject",
+			RotatingKeyRef: tokensv1alpha1.RotatingKeyRef{Name: "missing", Namespace: "failures"},
+		},
+	}
+	keyNotFound := issueFailuresTotal.WithLabelValues("failures", tokensv1alpha1.ReasonKeyNotFound)
+	signingFailed := issueFailuresTotal.WithLabelValues("failures", tokensv1alpha1.ReasonSigningFailed)
+
+	keys, _ := newTestRotatingKeyReconciler(t, token)
+	r := &JwtReconciler{Client: keys.Client, Log: keys.Log, Scheme: keys.Scheme, Recorder: keys.Recorder}
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "token", Namespace: "failures"}})
+	if err == nil {
+		t.Fatal("token of a missing key was issued")
+	}
+
+	if got := testutil.ToFloat64(keyNotFound); got != 1 {
+		t.Errorf("got %v failures with reason %s, want 1", got, tokensv1alpha1.ReasonKeyNotFound)
+	}
+	if got := testutil.ToFloat64(signingFailed); got != 0 {
+		t.Errorf("got %v failures with reason %s, want 0", got, tokensv1alpha1.ReasonSigningFailed)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Reasons a token is re-signed, used as label of the re-signing counter
+const (
+	refreshIssued   = "issued"
+	refreshClaims   = "claims"
+	refreshLifetime = "lifetime"
+	refreshExpiry   = "expiry"
+	refreshRotation = "rotation"
+	refreshRevoked  = "revoked"
+)
+
+// Triggers of a key rotation, used as label of the rotation counter
+const (
+	rotationScheduled = "scheduled"
+	rotationForced    = "forced"
+	rotationRevoked   = "revoked"
+)
+
+var (
+	jwtExpirySeconds = newDeadlineGauge(prometheus.NewDesc(
+		"toope_jwt_expiry_seconds",
+		"Seconds until the current token of the Jwt expires, negative once expired.",
+		[]string{"namespace", "name"}, nil,
+	))
+
+	rotatingKeyRotationSeconds = newDeadlineGauge(prometheus.NewDesc(
+		"toope_rotatingkey_next_rotation_seconds",
+		"Seconds until the next rotation of the RotatingKey, negative if overdue.",
+		[]string{"namespace", "name"}, nil,
+	))
+
+	rotationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "toope_rotatingkey_rotations_total",
+		Help: "Number of rotations of the signing key by trigger.",
+	}, []string{"namespace", "name", "trigger"})
+
+	resignsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "toope_jwt_resigns_total",
+		Help: "Number of tokens signed by reason.",
+	}, []string{"namespace", "reason"})
+
+	// Tokens fail to be issued before signing as well, e.g. on unresolved
+	// claims or a missing key, so the reason of the failed condition is kept
+	issueFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "toope_jwt_issue_failures_total",
+		Help: "Number of failed attempts to issue or refresh a token by the reason of the failed condition.",
+	}, []string{"namespace", "reason"})
+
+	signingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "toope_jwt_signing_duration_seconds",
+		Help:    "Latency of signing a token by algorithm and key backend.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"algorithm", "backend"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		jwtExpirySeconds,
+		rotatingKeyRotationSeconds,
+		rotationsTotal,
+		resignsTotal,
+		issueFailuresTotal,
+		signingDuration,
+	)
+}
+
+// deadlineGauge exports the seconds until a deadline of each object. The
+// seconds are computed when scraped, so the gauge does not go stale between
+// two reconciles.
+type deadlineGauge struct {
+	desc      *prometheus.Desc
+	mu        sync.Mutex
+	deadlines map[types.NamespacedName]time.Time
+}
+
+func newDeadlineGauge(desc *prometheus.Desc) *deadlineGauge {
+	return &deadlineGauge{desc: desc, deadlines: map[types.NamespacedName]time.Time{}}
+}
+
+// Set sets the deadline of the object.
+func (g *deadlineGauge) Set(name types.NamespacedName, deadline time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.deadlines[name] = deadline
+}
+
+// Delete removes the object, e.g. once it was deleted.
+func (g *deadlineGauge) Delete(name types.NamespacedName) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.deadlines, name)
+}
+
+func (g *deadlineGauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *deadlineGauge) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for name, deadline := range g.deadlines {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, deadline.Sub(now).Seconds(), name.Namespace, name.Name)
+	}
+}
@@ -18,30 +18,65 @@ package controllers
 
 import (
 	"context"
+	gocrypto "crypto"
+	"encoding/json"
+	"fmt"
 	"github.com/go-logr/logr"
 	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
 	"github.com/hexhibit-xyz/toope/crypto"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	rand2 "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
 	"time"
 )
 
+// JWKSConfigMapKey holds the JSON Web Key Set in the config map of a rotating key
+const JWKSConfigMapKey = "jwks.json"
+
+// secretKeyState holds the rotation state in the secret of a rotating key
+const secretKeyState = "state"
+
+// keyState is the rotation state stored next to the private keys. Keys and
+// state are written with a single update, so a rotation is either applied
+// completely or not at all, and the status only mirrors the secret.
+type keyState struct {
+	NextRotation     metav1.Time                    `json:"nextRotation"`
+	VerificationKeys []tokensv1alpha1.ValidationKey `json:"verificationKeys"`
+	LastRotateNow    string                         `json:"lastRotateNow,omitempty"`
+}
+
 // RotatingKeyReconciler reconciles a RotatingKey object
 type RotatingKeyReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Backends KeyBackends
+	Recorder record.EventRecorder
+}
+
+// KeyBackends configures the key backends shared by all rotating keys
+type KeyBackends struct {
+	// PKCS#11 token of the pkcs11 backend, nil if not configured
+	PKCS11 *crypto.PKCS11Config
+
+	// Vault transit engine of the vaultTransit backend, nil if not configured
+	Vault *crypto.VaultConfig
 }
 
 // +kubebuilder:rbac:groups=tokens.hexhibit.xyz,resources=rotatingkeys,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tokens.hexhibit.xyz,resources=rotatingkeys/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=tokens.hexhibit.xyz,resources=rotatingkeys/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 func (r *RotatingKeyReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -52,27 +87,80 @@ func (r *RotatingKeyReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			//Requested Object not found
+			rotatingKeyRotationSeconds.Delete(req.NamespacedName)
 			return log.errResult(err, "requested object not found, might be deleted")
 		}
 		return log.errResult(err, "")
 	}
+	// Keys created without the defaulting webhook
+	rotatingKey.Default()
+
+	deleted := !rotatingKey.DeletionTimestamp.IsZero()
+	if deleted && !hasFinalizer(rotatingKey, tokensv1alpha1.KeysFinalizer) {
+		// The secret and config map are removed with the rotating key
+		return ctrl.Result{}, nil
+	}
 
+	rotateNow := rotatingKey.Annotations[tokensv1alpha1.RotateNowAnnotation]
+
+	var cryptoKeys crypto.Keys
+	var lastRotateNow string
+	var created bool
+	// Keys generated by this reconcile, they are destroyed again if they
+	// could not be stored
+	var generated []crypto.Signer
 	secret := &v1.Secret{}
 
 	// Try to fetch the secret
 	// containing the private signing key
 	err = r.Client.Get(ctx, types.NamespacedName{Name: rotatingKey.Name, Namespace: rotatingKey.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return log.errResult(err, "failed to get secret")
+	}
+	found := err == nil
+
+	// The provider is created from the secret, as it holds the keys in use
+	provider, err := keyProvider(r.Backends, rotatingKey, secret)
+	if err != nil {
+		return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonBackendUnavailable, err, "failed to create key provider")
+	}
+
+	if deleted {
+		return r.finalize(ctx, log, rotatingKey, provider, secret, found)
+	}
+	// Keys held by the backend are not removed with the secret, the finalizer
+	// is set before any of them is generated
+	if _, ok := provider.(crypto.KeyDestroyer); ok && !hasFinalizer(rotatingKey, tokensv1alpha1.KeysFinalizer) {
+		patch := client.MergeFrom(rotatingKey.DeepCopy())
+		controllerutil.AddFinalizer(rotatingKey, tokensv1alpha1.KeysFinalizer)
+		err = r.Patch(ctx, rotatingKey, patch)
+		if err != nil {
+			return log.updateErrResult(err, "failed to add finalizer")
+		}
+		rotatingKey.Default()
+	}
+
 	//If not found, create new keys
-	if err != nil && errors.IsNotFound(err) {
+	if !found {
 
 		log.Info("keys not found, create new")
 
-		private, public, err := crypto.CreateKeys()
+		rotate, err := time.ParseDuration(rotatingKey.Spec.RotateAfter)
 		if err != nil {
-			return log.errResult(err, "failed to create keys")
+			return log.errResult(err, "unsupported duration format")
+		}
+
+		signer, err := provider.Generate()
+		if err != nil {
+			return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyGenerationFailed, err, "failed to create keys")
 		}
+		generated = append(generated, signer)
 
-		//Decode the private key and create a new secret
+		cryptoKeys = crypto.Keys{
+			SigningKey:   signer,
+			SigningKid:   rand2.String(20),
+			NextRotation: time.Now().Add(rotate),
+		}
 		secret = &v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      rotatingKey.Name,
@@ -80,126 +168,567 @@ func (r *RotatingKeyReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 			},
 			Type: "Opaque",
 		}
-		crypto.DecodedToSecret(private, secret)
-		err = r.Client.Create(context.Background(), secret, &client.CreateOptions{})
+		lastRotateNow = rotateNow
+		created = true
+
+	} else {
+		//Create key set from the secret
+		cryptoKeys, err = StatusToKeys(provider, rotatingKey, secret)
 		if err != nil {
-			return log.errResult(err, "failed to create secret")
+			return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyUnavailable, err, "failed to convert to crypto keys")
 		}
 
-		//Set new created public key as new verification key
-		rotatingKey.Status.SigningKey.PublicKey = public
-		rotatingKey.Status.SigningKey.KeyID = rand2.String(20)
-		rotate, err := time.ParseDuration(rotatingKey.Spec.RotateAfter)
+		state, err := loadKeyState(rotatingKey, secret)
 		if err != nil {
-			return log.errResult(err, "unsupported duration format")
+			return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyUnavailable, err, "failed to decode key state")
 		}
-		rotatingKey.Status.NexRotation.Time = time.Now().Add(rotate)
+		lastRotateNow = state.LastRotateNow
+	}
 
-	} else if err != nil {
-		return log.errResult(err, "failed to get secret")
+	publishAt, err := publishNextAt(rotatingKey.Spec, cryptoKeys.NextRotation)
+	if err != nil {
+		return log.errResult(err, "unsupported duration format")
+	}
+
+	strategy, err := crypto.NewRotationStrategy(provider, rotatingKey.Spec.RotateAfter, rotatingKey.Spec.MaxTokenLifetime())
+	if err != nil {
+		return log.errResult(err, "failed to create strategy")
+	}
+	rotator := crypto.NewRotater(strategy)
+
+	// Revoked keys are dropped before the rotation, so a revoked successor is
+	// never promoted, and after it, so a revoked signing key is not kept
+	revoked := revokedKeyIDs(rotatingKey)
+	revokedRotation := rotatesRevoked(provider, cryptoKeys, revoked)
+	var destroy []crypto.Signer
+	if cryptoKeys.NextKey != nil && revoked[cryptoKeys.NextKid] {
+		destroy = append(destroy, cryptoKeys.NextKey)
+	}
+	revokedChanged := crypto.Revoke(&cryptoKeys, revoked)
+
+	// The rotation is due according to the secret, not the status, so a
+	// rotation is never repeated because the status lags behind
+	forced := rotateNow != "" && rotateNow != lastRotateNow
+	hadNext := cryptoKeys.NextKey != nil
+	var rotated crypto.Signer
+	var trigger string
+	var prepared bool
+	switch {
+	case forced || revokedRotation:
+		log.Info("force rotation", "forced", forced, "revoked", revokedRotation)
+
+		trigger = rotationForced
+		if revokedRotation {
+			trigger = rotationRevoked
+		}
+		rotated = cryptoKeys.SigningKey
+		err = rotator.ForceRotate(&cryptoKeys)
+	case !time.Now().Before(cryptoKeys.NextRotation):
+		trigger = rotationScheduled
+		rotated = cryptoKeys.SigningKey
+		err = rotator.Rotate(&cryptoKeys)
+	case publishAt != nil && cryptoKeys.NextKey == nil && !time.Now().Before(*publishAt):
+		prepared = true
+		err = rotator.Prepare(&cryptoKeys)
+	}
+	if err != nil {
+		return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionDegraded, tokensv1alpha1.ReasonRotationFailed, err, "failed to rotate")
+	}
+	if rotated != nil {
+		crypto.Revoke(&cryptoKeys, revoked)
+		destroy = append(destroy, rotated)
+		lastRotateNow = rotateNow
+	}
+	// A rotation without successor and a preparation generate a new key
+	if rotated != nil && !hadNext {
+		generated = append(generated, cryptoKeys.SigningKey)
+	} else if prepared {
+		generated = append(generated, cryptoKeys.NextKey)
 	}
 
-	//Create key set from status
-	cryptoKeys, err := StatusToKeys(rotatingKey, secret)
+	status, err := KeysToStatus(cryptoKeys, rotatingKey.Spec)
 	if err != nil {
-		return log.errResult(err, "failed to convert to crypto keys")
+		return log.errResult(err, "failed to convert crypto keys to status")
 	}
+	status.LastRotateNow = lastRotateNow
+	status.ObservedGeneration = rotatingKey.Generation
+	status.Conditions = append([]tokensv1alpha1.Condition(nil), rotatingKey.Status.Conditions...)
+	setCondition(&status.Conditions, rotatingKey.Generation, tokensv1alpha1.ConditionKeyAvailable, true, tokensv1alpha1.ReasonKeyLoaded,
+		fmt.Sprintf("Signing key %s is available", cryptoKeys.SigningKid))
+	setCondition(&status.Conditions, rotatingKey.Generation, tokensv1alpha1.ConditionReady, true, tokensv1alpha1.ReasonReconciled,
+		fmt.Sprintf("Next rotation at %s", status.NexRotation.UTC().Format(time.RFC3339)))
+	setCondition(&status.Conditions, rotatingKey.Generation, tokensv1alpha1.ConditionDegraded, false, tokensv1alpha1.ReasonReconciled, "")
+
+	// Keys and rotation state are written with a single update of the
+	// secret. A stale secret fails with a conflict instead of overwriting
+	// keys rotated in the meantime.
+	if created || rotated != nil || prepared || revokedChanged {
+		err = keysToSecret(provider, cryptoKeys, status, secret)
+		if err != nil {
+			r.destroyKeys(log, provider, generated, "failed to destroy unstored signing key")
+			return log.errResult(err, "failed to encode keys")
+		}
 
-	nextRoation := rotatingKey.Status.NexRotation.Time
-	if metav1.Now().After(nextRoation) {
-		strategy, err := crypto.NewRotationStrategy(rotatingKey.Spec.Algorithm, rotatingKey.Spec.RotateAfter, rotatingKey.Spec.Lifetime)
+		err = controllerutil.SetControllerReference(rotatingKey, secret, r.Scheme)
 		if err != nil {
-			return log.errResult(err, "failed to create strategy")
+			r.destroyKeys(log, provider, generated, "failed to destroy unstored signing key")
+			return log.errResult(err, "failed to set secret controller reference")
 		}
 
-		rotator := crypto.NewRotater(strategy)
-		err = rotator.Rotate(&cryptoKeys)
+		if created {
+			err = r.Client.Create(ctx, secret, &client.CreateOptions{})
+		} else {
+			err = r.Client.Update(ctx, secret)
+		}
 		if err != nil {
-			return log.errResult(err, "failed to rotate")
+			// Nothing references the generated keys, the next reconcile
+			// generates its own ones
+			r.destroyKeys(log, provider, generated, "failed to destroy unstored signing key")
+			if staleWrite(err) {
+				return log.updateErrResult(err, "failed to write keys to secret")
+			}
+			// Without a secret there is no key to sign with, otherwise the
+			// stored keys keep signing
+			failed := tokensv1alpha1.ConditionDegraded
+			if created {
+				failed = tokensv1alpha1.ConditionKeyAvailable
+			}
+			return r.failed(ctx, log, rotatingKey, failed, tokensv1alpha1.ReasonUpdateFailed, err, "failed to write keys to secret")
 		}
 
-		crypto.ToSecret(cryptoKeys.SigningKey, secret)
-		err = r.Update(ctx, secret)
+		// The secret no longer references the rotated and revoked keys, so
+		// they are removed before anything else can fail
+		r.destroyKeys(log, provider, destroy, "failed to destroy rotated signing key")
+
+		switch {
+		case created:
+			r.Recorder.Eventf(rotatingKey, v1.EventTypeNormal, tokensv1alpha1.ReasonKeyCreated, "Created signing key %s", cryptoKeys.SigningKid)
+		case rotated != nil:
+			rotationsTotal.WithLabelValues(rotatingKey.Namespace, rotatingKey.Name, trigger).Inc()
+			r.Recorder.Eventf(rotatingKey, v1.EventTypeNormal, tokensv1alpha1.ReasonKeyRotated, "Rotated to signing key %s", cryptoKeys.SigningKid)
+		case prepared:
+			r.Recorder.Eventf(rotatingKey, v1.EventTypeNormal, tokensv1alpha1.ReasonKeyPrepared, "Published next signing key %s", cryptoKeys.NextKid)
+		}
+		if revokedChanged {
+			r.Recorder.Event(rotatingKey, v1.EventTypeNormal, tokensv1alpha1.ReasonKeyRevoked, "Removed revoked keys")
+		}
+	}
+
+	// The key set is only published once the keys are stored, so a lost
+	// rotation never publishes a key which does not sign. Keys published
+	// ahead of their rotation are known before any token is signed with them,
+	// a failed update is repeated by the next reconcile.
+	err = r.updateJWKS(ctx, rotatingKey, cryptoKeys)
+	if errors.IsConflict(err) {
+		return log.updateErrResult(err, "failed to update jwks config map")
+	} else if err != nil {
+		return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionDegraded, tokensv1alpha1.ReasonPublishFailed, err, "failed to update jwks config map")
+	}
+
+	// The status only mirrors the secret, a failed update is repeated from
+	// the secret by the next reconcile
+	if !equality.Semantic.DeepEqual(rotatingKey.Status, status) {
+		rotatingKey.Status = status
+		err = r.Status().Update(ctx, rotatingKey)
 		if err != nil {
-			return log.errResult(err, "failed to update secret with new private key")
+			if !staleWrite(err) {
+				r.Recorder.Eventf(rotatingKey, v1.EventTypeWarning, tokensv1alpha1.ReasonUpdateFailed, "failed to update rotating key status: %v", err)
+			}
+			return log.updateErrResult(err, "failed to update rotating key status")
 		}
 	}
+	rotatingKeyRotationSeconds.Set(req.NamespacedName, cryptoKeys.NextRotation)
+
+	next := cryptoKeys.NextRotation.Sub(time.Now()) + 1*time.Minute
 
-	rotatingKey.Status = KeysToStatus(cryptoKeys)
+	// Wake up in time to publish the next key
+	publishAt, err = publishNextAt(rotatingKey.Spec, cryptoKeys.NextRotation)
+	if err == nil && publishAt != nil && cryptoKeys.NextKey == nil {
+		if untilPublish := publishAt.Sub(time.Now()); untilPublish > 0 && untilPublish < next {
+			next = untilPublish
+		}
+	}
 
-	err = r.Status().Update(ctx, rotatingKey)
+	return ctrl.Result{RequeueAfter: next}, nil
+}
+
+// failed records the error in the conditions and as event. Failures of the
+// key make the rotating key unready, failures passed as degraded keep signing
+// with the current key.
+func (r *RotatingKeyReconciler) failed(ctx context.Context, log Logger, rotatingKey *tokensv1alpha1.RotatingKey, failed tokensv1alpha1.ConditionType, reason string, err error, msg string) (ctrl.Result, error) {
+	rotatingKey.Status.ObservedGeneration = rotatingKey.Generation
+	setFailedConditions(&rotatingKey.Status.Conditions, rotatingKey.Generation, failed, reason, err.Error())
+
+	r.Recorder.Eventf(rotatingKey, v1.EventTypeWarning, reason, "%s: %v", msg, err)
+
+	statusErr := r.Status().Update(ctx, rotatingKey)
+	if statusErr != nil {
+		r.Recorder.Eventf(rotatingKey, v1.EventTypeWarning, tokensv1alpha1.ReasonUpdateFailed, "failed to update rotating key status: %v", statusErr)
+		log.Error(statusErr, "failed to update rotating key status")
+	}
+
+	return log.errResult(err, msg)
+}
+
+// finalize destroys the signing key and its successor held by the backend of
+// a deleted rotating key, rotated keys were destroyed by their rotation. Keys
+// held as versions are destroyed by deleting the backend key. The
+// finalizer is kept until all keys are destroyed, keys already missing in the
+// backend are skipped.
+func (r *RotatingKeyReconciler) finalize(ctx context.Context, log Logger, rotatingKey *tokensv1alpha1.RotatingKey, provider crypto.KeyProvider, secret *v1.Secret, found bool) (ctrl.Result, error) {
+	// The backend key is deleted with all versions, even if they were
+	// never stored
+	if destroyer, ok := provider.(crypto.VersionDestroyer); ok {
+		err := destroyer.DestroyAll()
+		if err != nil {
+			return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionDegraded, tokensv1alpha1.ReasonDestroyFailed, err, "failed to destroy keys")
+		}
+	} else if destroyer, ok := provider.(crypto.KeyDestroyer); ok && found {
+		var signers []crypto.Signer
+		next, _, err := crypto.NextFromSecret(provider, secret)
+		if err != nil && !crypto.IsKeyNotFound(err) {
+			return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyUnavailable, err, "failed to load next key")
+		}
+		if next != nil {
+			signers = append(signers, next)
+		}
+		signer, err := provider.FromSecret(secret)
+		if err != nil && !crypto.IsKeyNotFound(err) {
+			return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionKeyAvailable, tokensv1alpha1.ReasonKeyUnavailable, err, "failed to load signing key")
+		}
+		if signer != nil {
+			signers = append(signers, signer)
+		}
+
+		for _, signer := range signers {
+			err = destroyer.Destroy(signer)
+			if err != nil {
+				return r.failed(ctx, log, rotatingKey, tokensv1alpha1.ConditionDegraded, tokensv1alpha1.ReasonDestroyFailed, err, "failed to destroy key")
+			}
+		}
+		log.Info("destroyed keys of deleted rotating key", "keys", len(signers))
+	}
+
+	patch := client.MergeFrom(rotatingKey.DeepCopy())
+	controllerutil.RemoveFinalizer(rotatingKey, tokensv1alpha1.KeysFinalizer)
+	err := r.Patch(ctx, rotatingKey, patch)
 	if err != nil {
-		return log.errResult(err, "failed to update rotating key status")
+		return log.updateErrResult(err, "failed to remove finalizer")
+	}
+	return ctrl.Result{}, nil
+}
+
+// rotatesRevoked reports whether the revoked keys force a rotation of the
+// signing key. Besides a revoked signing key, a revoked successor of keys held
+// as versions is rotated past, as it can only be destroyed together with the
+// signing key.
+func rotatesRevoked(provider crypto.KeyProvider, keys crypto.Keys, revoked map[string]bool) bool {
+	if revoked[keys.SigningKid] {
+		return true
 	}
+	_, versions := provider.(crypto.VersionDestroyer)
+	return versions && keys.NextKey != nil && revoked[keys.NextKid]
+}
+
+func hasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
 
-	err = controllerutil.SetControllerReference(rotatingKey, secret, r.Scheme)
+// destroyKeys removes private keys held outside of the secret from their
+// backend. Failures are only logged, the keys can not be signed with anymore.
+func (r *RotatingKeyReconciler) destroyKeys(log Logger, provider crypto.KeyProvider, signers []crypto.Signer, msg string) {
+	destroyer, ok := provider.(crypto.KeyDestroyer)
+	if !ok {
+		return
+	}
+
+	for _, signer := range signers {
+		err := destroyer.Destroy(signer)
+		if err != nil {
+			log.Error(err, msg)
+		}
+	}
+}
+
+// revokedKeyIDs returns the key IDs listed in the revoke annotation.
+func revokedKeyIDs(rotatingKey *tokensv1alpha1.RotatingKey) map[string]bool {
+	revoked := map[string]bool{}
+	for _, kid := range strings.Split(rotatingKey.Annotations[tokensv1alpha1.RevokeAnnotation], ",") {
+		kid = strings.TrimSpace(kid)
+		if kid != "" {
+			revoked[kid] = true
+		}
+	}
+	return revoked
+}
+
+// publishNextAt returns the time the next signing key is published, nil if
+// keys are not published ahead of their rotation.
+func publishNextAt(spec tokensv1alpha1.RotatingKeySpec, nextRotation time.Time) (*time.Time, error) {
+	if spec.PublishBefore == "" {
+		return nil, nil
+	}
+
+	before, err := time.ParseDuration(spec.PublishBefore)
 	if err != nil {
-		return log.errResult(err, "failed to set token controller reference")
+		return nil, err
 	}
 
-	next := rotatingKey.Status.NexRotation.Sub(time.Now()) + 1*time.Minute
+	at := nextRotation.Add(-before)
+	return &at, nil
+}
 
-	return ctrl.Result{RequeueAfter: next}, nil
+// loadKeyState reads the rotation state stored in the secret. Secrets written
+// before the state was stored fall back to the status.
+func loadKeyState(rotatingKey *tokensv1alpha1.RotatingKey, secret *v1.Secret) (keyState, error) {
+	encoded := secret.Data[secretKeyState]
+	if len(encoded) == 0 {
+		state := keyState{
+			VerificationKeys: rotatingKey.Status.VerificationKeys,
+			LastRotateNow:    rotatingKey.Status.LastRotateNow,
+		}
+		if rotatingKey.Status.NexRotation != nil {
+			state.NextRotation = *rotatingKey.Status.NexRotation
+		}
+		return state, nil
+	}
+
+	state := keyState{}
+	err := json.Unmarshal(encoded, &state)
+	return state, err
+}
+
+// keysToSecret stores the private keys together with the rotation state of
+// the status in the secret.
+func keysToSecret(provider crypto.KeyProvider, keys crypto.Keys, status tokensv1alpha1.RotatingKeyStatus, secret *v1.Secret) error {
+	err := provider.ToSecret(keys.SigningKey, keys.SigningKid, secret)
+	if err != nil {
+		return err
+	}
+
+	if keys.NextKey != nil {
+		err = crypto.NextToSecret(provider, keys.NextKey, keys.NextKid, secret)
+		if err != nil {
+			return err
+		}
+	} else {
+		crypto.RemoveNextFromSecret(secret)
+	}
+
+	err = crypto.VerificationKeysToSecret(keys.VerificationKeys, secret)
+	if err != nil {
+		return err
+	}
+
+	state, err := json.Marshal(keyState{
+		NextRotation:     *status.NexRotation,
+		VerificationKeys: status.VerificationKeys,
+		LastRotateNow:    status.LastRotateNow,
+	})
+	if err != nil {
+		return err
+	}
+	secret.StringData[secretKeyState] = string(state)
+	return nil
+}
+
+// updateJWKS writes the key set of the rotating key to the config map named
+// after the key. The whole set is replaced with a single update.
+func (r *RotatingKeyReconciler) updateJWKS(ctx context.Context, rotatingKey *tokensv1alpha1.RotatingKey, keys crypto.Keys) error {
+	jwks, err := crypto.NewJWKS(keys, rotatingKey.Spec.Algorithm, time.Now())
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(jwks)
+	if err != nil {
+		return err
+	}
+
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      rotatingKey.Name,
+			Namespace: rotatingKey.Namespace,
+		},
+	}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		configMap.Labels = defaultLabels
+		configMap.Data = map[string]string{JWKSConfigMapKey: string(encoded)}
+		return controllerutil.SetControllerReference(rotatingKey, configMap, r.Scheme)
+	})
+	return err
 }
 
 func (r *RotatingKeyReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&tokensv1alpha1.RotatingKey{}).
 		Owns(&v1.Secret{}).
+		Owns(&v1.ConfigMap{}).
 		Complete(r)
 }
 
-func StatusToKeys(key *tokensv1alpha1.RotatingKey, secret *v1.Secret) (crypto.Keys, error) {
-	vks := key.Status.VerificationKeys
+// keyProvider returns the provider of the signing keys of a rotating key,
+// which are stored in the secret. The secret is empty before the first keys
+// are stored.
+func keyProvider(backends KeyBackends, rotatingKey *tokensv1alpha1.RotatingKey, secret *v1.Secret) (crypto.KeyProvider, error) {
+	spec := rotatingKey.Spec
+	switch spec.Backend {
+	case "", tokensv1alpha1.KeyBackendLocal:
+		return crypto.NewLocalProvider(spec.Algorithm, spec.KeySize), nil
+	case tokensv1alpha1.KeyBackendPKCS11:
+		if backends.PKCS11 == nil {
+			return nil, fmt.Errorf("pkcs11 backend is not configured")
+		}
+		return crypto.NewPKCS11Provider(*backends.PKCS11, spec.Algorithm, spec.KeySize)
+	case tokensv1alpha1.KeyBackendVault:
+		if backends.Vault == nil {
+			return nil, fmt.Errorf("vaultTransit backend is not configured")
+		}
+		// Namespaces can not contain dots, so the key name is unique
+		key := rotatingKey.Namespace + "." + rotatingKey.Name
+		return crypto.NewVaultTransitProvider(*backends.Vault, key, spec.Algorithm, spec.KeySize, secret)
+	}
 
-	privateKey, err := crypto.FromSecret(secret)
+	return nil, fmt.Errorf("unsupported key backend %s", spec.Backend)
+}
+
+// StatusToKeys loads the keys of the rotating key from its secret, using the
+// rotation state stored in the secret or the status for older secrets.
+func StatusToKeys(provider crypto.KeyProvider, key *tokensv1alpha1.RotatingKey, secret *v1.Secret) (crypto.Keys, error) {
+	state, err := loadKeyState(key, secret)
 	if err != nil {
 		return crypto.Keys{}, err
 	}
+	vks := state.VerificationKeys
 
-	keys := make([]crypto.VerificationKey, len(vks))
-	for i, k := range vks {
+	signer, err := provider.FromSecret(secret)
+	if err != nil {
+		return crypto.Keys{}, err
+	}
 
-		pub, err := crypto.EncodePublicRSA(k.PublicKey)
-		if err != nil {
-			return crypto.Keys{}, err
+	next, nextKid, err := crypto.NextFromSecret(provider, secret)
+	if err != nil {
+		return crypto.Keys{}, err
+	}
+
+	// Symmetric keys are not published, they are kept in the secret
+	symmetric, err := crypto.VerificationKeysFromSecret(secret)
+	if err != nil {
+		return crypto.Keys{}, err
+	}
+
+	keys := make([]crypto.VerificationKey, 0, len(vks))
+	for _, k := range vks {
+		// The next key is published as verification key, but kept as successor
+		if next != nil && k.KeyID == nextKid {
+			continue
+		}
+
+		var pub gocrypto.PublicKey
+		if k.PublicKey != "" {
+			pub, err = crypto.EncodePublic(k.PublicKey)
+			if err != nil {
+				return crypto.Keys{}, err
+			}
+		} else if secretKey, ok := symmetric[k.KeyID]; ok {
+			pub = secretKey
+		} else {
+			// Lost keys can not verify anything anymore
+			continue
 		}
 
-		keys[i] = crypto.VerificationKey{
-			PublicKey: *pub,
+		keys = append(keys, crypto.VerificationKey{
+			PublicKey: pub,
 			Expiry:    k.ExpireAt.Time,
 			Kid:       k.KeyID,
-		}
+		})
+	}
+
+	// The key ID stored with the private key wins over the status
+	kid := crypto.KidFromSecret(secret)
+	if kid == "" {
+		kid = key.Status.SigningKey.KeyID
 	}
 
 	return crypto.Keys{
-		SigningKey:       privateKey,
+		SigningKey:       signer,
 		VerificationKeys: keys,
-		NextRotation:     key.Status.NexRotation.Time,
-		SigningKid:       key.Status.SigningKey.KeyID,
+		NextRotation:     state.NextRotation.Time,
+		SigningKid:       kid,
+		NextKey:          next,
+		NextKid:          nextKid,
 	}, nil
 
 }
 
-func KeysToStatus(keys crypto.Keys) tokensv1alpha1.RotatingKeyStatus {
-	valK := make([]tokensv1alpha1.ValidationKey, len(keys.VerificationKeys))
+func KeysToStatus(keys crypto.Keys, spec tokensv1alpha1.RotatingKeySpec) (tokensv1alpha1.RotatingKeyStatus, error) {
+	valK := make([]tokensv1alpha1.ValidationKey, len(keys.VerificationKeys), len(keys.VerificationKeys)+1)
 
 	for i, k := range keys.VerificationKeys {
+		public, err := statusPublicKey(k.PublicKey)
+		if err != nil {
+			return tokensv1alpha1.RotatingKeyStatus{}, err
+		}
+
 		valK[i] = tokensv1alpha1.ValidationKey{
 			KeyID:     k.Kid,
 			Use:       "enc",
-			PublicKey: crypto.DecodeRSAPublic(k.PublicKey),
+			PublicKey: public,
 			ExpireAt:  metav1.NewTime(k.Expiry),
 		}
 	}
 
+	// The next key signs after the rotation and verifies for another maximum
+	// token lifetime
+	if keys.NextKey != nil {
+		public, err := statusPublicKey(keys.NextKey.Public())
+		if err != nil {
+			return tokensv1alpha1.RotatingKeyStatus{}, err
+		}
+
+		rotate, err := time.ParseDuration(spec.RotateAfter)
+		if err != nil {
+			return tokensv1alpha1.RotatingKeyStatus{}, err
+		}
+		lifetime, err := time.ParseDuration(spec.MaxTokenLifetime())
+		if err != nil {
+			return tokensv1alpha1.RotatingKeyStatus{}, err
+		}
+
+		valK = append(valK, tokensv1alpha1.ValidationKey{
+			KeyID:     keys.NextKid,
+			Use:       "enc",
+			PublicKey: public,
+			ExpireAt:  metav1.NewTime(keys.NextRotation.Add(rotate + lifetime)),
+		})
+	}
+
+	public, err := statusPublicKey(keys.SigningKey.Public())
+	if err != nil {
+		return tokensv1alpha1.RotatingKeyStatus{}, err
+	}
+
 	return tokensv1alpha1.RotatingKeyStatus{
-		NexRotation:      metav1.NewTime(keys.NextRotation),
+		NexRotation:      timePtr(keys.NextRotation),
 		VerificationKeys: valK,
 		SigningKey: tokensv1alpha1.SigningKey{
 			KeyID:     keys.SigningKid,
 			Use:       "sig",
-			PublicKey: crypto.DecodeRSAPublic(keys.SigningKey.PublicKey),
+			PublicKey: public,
 		},
+	}, nil
+}
+
+// statusPublicKey encodes the public key for the status, symmetric keys are
+// left empty as they must not be published.
+func statusPublicKey(key gocrypto.PublicKey) (string, error) {
+	if crypto.IsSymmetric(key) {
+		return "", nil
 	}
+	return crypto.DecodePublic(key)
 }
@@ -0,0 +1,507 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	"github.com/hexhibit-xyz/toope/crypto"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// secretWriter stores the string data of secrets as the API server does. It
+// fails secret updates with a conflict while conflict is set and all secret
+// writes with err while it is set.
+type secretWriter struct {
+	client.Client
+	conflict bool
+	err      error
+}
+
+func (c *secretWriter) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*v1.Secret); ok && c.err != nil {
+		return c.err
+	}
+	storeStringData(obj)
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *secretWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if secret, ok := obj.(*v1.Secret); ok && c.conflict {
+		return errors.NewConflict(v1.Resource("secrets"), secret.Name, nil)
+	} else if ok && c.err != nil {
+		return c.err
+	}
+	storeStringData(obj)
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func storeStringData(obj runtime.Object) {
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		return
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	secret.StringData = nil
+}
+
+func newTestRotatingKeyReconciler(t *testing.T, objects ...runtime.Object) (*RotatingKeyReconciler, *secretWriter) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokensv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &secretWriter{Client: fake.NewFakeClientWithScheme(scheme, objects...)}
+	return &RotatingKeyReconciler{
+		Client:   c,
+		Log:      ctrl.Log,
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(100),
+	}, c
+}
+
+func publishedKids(t *testing.T, c client.Client, name types.NamespacedName) []string {
+	configMap := &v1.ConfigMap{}
+	if err := c.Get(context.Background(), name, configMap); err != nil {
+		t.Fatal(err)
+	}
+	jwks := crypto.JWKS{}
+	if err := json.Unmarshal([]byte(configMap.Data[JWKSConfigMapKey]), &jwks); err != nil {
+		t.Fatal(err)
+	}
+
+	var kids []string
+	for _, k := range jwks.Keys {
+		kids = append(kids, k.Kid)
+	}
+	return kids
+}
+
+func TestConflictedRotationIsNotPublished(t *testing.T) {
+	name := types.NamespacedName{Name: "key", Namespace: "default"}
+	r, c := newTestRotatingKeyReconciler(t, &tokensv1alpha1.RotatingKey{
+		ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace},
+		Spec:       tokensv1alpha1.RotatingKeySpec{Algorithm: "ES256", Lifetime: "1h", RotateAfter: "1h"},
+	})
+	req := ctrl.Request{NamespacedName: name}
+
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	secret := &v1.Secret{}
+	if err := c.Get(context.Background(), name, secret); err != nil {
+		t.Fatal(err)
+	}
+	kid := crypto.KidFromSecret(secret)
+	if kids := publishedKids(t, c, name); len(kids) != 1 || kids[0] != kid {
+		t.Fatalf("published %v, want [%s]", kids, kid)
+	}
+
+	// The rotation is due, but the secret was changed in the meantime
+	state := keyState{}
+	if err := json.Unmarshal(secret.Data[secretKeyState], &state); err != nil {
+		t.Fatal(err)
+	}
+	state.NextRotation = metav1.NewTime(time.Now().Add(-time.Minute))
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data[secretKeyState] = encoded
+	if err := c.Update(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+
+	c.conflict = true
+	res, err := r.Reconcile(req)
+	if err != nil || !res.Requeue {
+		t.Fatalf("conflict not requeued: %v, %v", res, err)
+	}
+	if kids := publishedKids(t, c, name); len(kids) != 1 || kids[0] != kid {
+		t.Fatalf("conflicted rotation published %v, want [%s]", kids, kid)
+	}
+
+	c.conflict = false
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	if kids := publishedKids(t, c, name); len(kids) != 2 {
+		t.Fatalf("rotation published %v, want the rotated and the new key", kids)
+	}
+}
+
+func testKeys(t *testing.T, provider crypto.KeyProvider, nextRotation time.Time) crypto.Keys {
+	generate := func() crypto.Signer {
+		signer, err := provider.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+
+	return crypto.Keys{
+		SigningKey: generate(),
+		SigningKid: "signing",
+		NextKey:    generate(),
+		NextKid:    "next",
+		VerificationKeys: []crypto.VerificationKey{
+			{PublicKey: generate().Public(), Kid: "rotated", Expiry: nextRotation.Add(-time.Hour)},
+		},
+		NextRotation: nextRotation,
+	}
+}
+
+func TestFailedSecretWriteIsReported(t *testing.T) {
+	keyName := types.NamespacedName{Name: "key", Namespace: "default"}
+	tokenName := types.NamespacedName{Name: "token", Namespace: "default"}
+	r, c := newTestRotatingKeyReconciler(t,
+		&tokensv1alpha1.RotatingKey{
+			ObjectMeta: metav1.ObjectMeta{Name: keyName.Name, Namespace: keyName.Namespace},
+			Spec:       tokensv1alpha1.RotatingKeySpec{Algorithm: "ES256", Lifetime: "1h", RotateAfter: "1h"},
+		},
+		&tokensv1alpha1.Jwt{
+			ObjectMeta: metav1.ObjectMeta{Name: tokenName.Name, Namespace: tokenName.Namespace},
+			Spec: tokensv1alpha1.JwtSpec{
+				Subject:        "subject",
+				RotatingKeyRef: tokensv1alpha1.RotatingKeyRef{Name: keyName.Name},
+			},
+		})
+	tokens := &JwtReconciler{Client: r.Client, Log: r.Log, Scheme: r.Scheme, Recorder: r.Recorder}
+	c.err = errors.NewForbidden(v1.Resource("secrets"), "", nil)
+
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: keyName}); err == nil {
+		t.Fatal("unstored key reconciled")
+	}
+	key := &tokensv1alpha1.RotatingKey{}
+	if err := c.Get(context.Background(), keyName, key); err != nil {
+		t.Fatal(err)
+	}
+	if cond := tokensv1alpha1.FindCondition(key.Status.Conditions, tokensv1alpha1.ConditionKeyAvailable); cond == nil || cond.Reason != tokensv1alpha1.ReasonUpdateFailed {
+		t.Errorf("got key condition %v, want reason %s", cond, tokensv1alpha1.ReasonUpdateFailed)
+	}
+
+	c.err = nil
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: keyName}); err != nil {
+		t.Fatal(err)
+	}
+	c.err = errors.NewForbidden(v1.Resource("secrets"), "", nil)
+
+	if _, err := tokens.Reconcile(ctrl.Request{NamespacedName: tokenName}); err == nil {
+		t.Fatal("unstored token reconciled")
+	}
+	token := &tokensv1alpha1.Jwt{}
+	if err := c.Get(context.Background(), tokenName, token); err != nil {
+		t.Fatal(err)
+	}
+	if cond := tokensv1alpha1.FindCondition(token.Status.Conditions, tokensv1alpha1.ConditionSigned); cond == nil || cond.Reason != tokensv1alpha1.ReasonUpdateFailed {
+		t.Errorf("got token condition %v, want reason %s", cond, tokensv1alpha1.ReasonUpdateFailed)
+	}
+	if token.Status.Error == "" {
+		t.Error("error not stored")
+	}
+}
+
+// destroyingProvider records the keys destroyed through it, or fails with err
+// while it is set.
+type destroyingProvider struct {
+	crypto.KeyProvider
+	destroyed []crypto.Signer
+	err       error
+}
+
+func (p *destroyingProvider) Destroy(signer crypto.Signer) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.destroyed = append(p.destroyed, signer)
+	return nil
+}
+
+func TestFinalizeDestroysKeys(t *testing.T) {
+	name := types.NamespacedName{Name: "key", Namespace: "default"}
+	provider := &destroyingProvider{KeyProvider: crypto.NewLocalProvider("ES256", 0)}
+	signing, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+	if err := provider.ToSecret(signing, "signing", secret); err != nil {
+		t.Fatal(err)
+	}
+	storeStringData(secret)
+	if err := crypto.NextToSecret(provider, next, "next", secret); err != nil {
+		t.Fatal(err)
+	}
+	storeStringData(secret)
+
+	deletedAt := metav1.Now()
+	r, c := newTestRotatingKeyReconciler(t, &tokensv1alpha1.RotatingKey{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name.Name,
+			Namespace:         name.Namespace,
+			DeletionTimestamp: &deletedAt,
+			Finalizers:        []string{tokensv1alpha1.KeysFinalizer},
+		},
+		Spec: tokensv1alpha1.RotatingKeySpec{Algorithm: "ES256", Lifetime: "1h", RotateAfter: "1h"},
+	}, secret)
+	load := func() *tokensv1alpha1.RotatingKey {
+		key := &tokensv1alpha1.RotatingKey{}
+		if err := c.Get(context.Background(), name, key); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	log := Logger{r.Log}
+
+	// The finalizer is kept until the keys are destroyed
+	provider.err = errors.NewServiceUnavailable("backend unavailable")
+	if _, err := r.finalize(context.Background(), log, load(), provider, secret, true); err == nil {
+		t.Fatal("failed destroy finalized")
+	}
+	key := load()
+	if !hasFinalizer(key, tokensv1alpha1.KeysFinalizer) {
+		t.Fatal("finalizer removed before the keys were destroyed")
+	}
+	if cond := tokensv1alpha1.FindCondition(key.Status.Conditions, tokensv1alpha1.ConditionDegraded); cond == nil || cond.Reason != tokensv1alpha1.ReasonDestroyFailed {
+		t.Errorf("got degraded condition %v, want reason %s", cond, tokensv1alpha1.ReasonDestroyFailed)
+	}
+
+	provider.err = nil
+	if _, err := r.finalize(context.Background(), log, key, provider, secret, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.destroyed) != 2 ||
+		!reflect.DeepEqual(provider.destroyed[0].Public(), next.Public()) ||
+		!reflect.DeepEqual(provider.destroyed[1].Public(), signing.Public()) {
+		t.Errorf("destroyed %d keys, want the next and the signing key", len(provider.destroyed))
+	}
+	if hasFinalizer(load(), tokensv1alpha1.KeysFinalizer) {
+		t.Error("finalizer kept after the keys were destroyed")
+	}
+}
+
+// versionDestroyingProvider holds its keys as versions of a single key
+type versionDestroyingProvider struct {
+	destroyingProvider
+	destroyedAll bool
+}
+
+func (p *versionDestroyingProvider) DestroyAll() error {
+	p.destroyedAll = true
+	return nil
+}
+
+func TestFinalizeDestroysAllVersions(t *testing.T) {
+	name := types.NamespacedName{Name: "key", Namespace: "default"}
+	deletedAt := metav1.Now()
+	key := &tokensv1alpha1.RotatingKey{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name.Name,
+			Namespace:         name.Namespace,
+			DeletionTimestamp: &deletedAt,
+			Finalizers:        []string{tokensv1alpha1.KeysFinalizer},
+		},
+	}
+	r, c := newTestRotatingKeyReconciler(t, key)
+	provider := &versionDestroyingProvider{destroyingProvider: destroyingProvider{KeyProvider: crypto.NewLocalProvider("ES256", 0)}}
+
+	// Versions are deleted even if the secret was never stored
+	if _, err := r.finalize(context.Background(), Logger{r.Log}, key, provider, &v1.Secret{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !provider.destroyedAll {
+		t.Error("backend key not deleted")
+	}
+	if len(provider.destroyed) != 0 {
+		t.Errorf("destroyed %d single keys, want the backend key", len(provider.destroyed))
+	}
+	if err := c.Get(context.Background(), name, key); err != nil {
+		t.Fatal(err)
+	}
+	if hasFinalizer(key, tokensv1alpha1.KeysFinalizer) {
+		t.Error("finalizer kept after the keys were destroyed")
+	}
+}
+
+func TestRotatesRevoked(t *testing.T) {
+	local := crypto.NewLocalProvider("ES256", 0)
+	next, err := local.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := crypto.Keys{SigningKid: "signing", NextKey: next, NextKid: "next"}
+	versions := &versionDestroyingProvider{destroyingProvider: destroyingProvider{KeyProvider: local}}
+
+	tests := []struct {
+		name     string
+		provider crypto.KeyProvider
+		revoked  string
+		want     bool
+	}{
+		{name: "nothing revoked", provider: versions, want: false},
+		{name: "signing key", provider: local, revoked: "signing", want: true},
+		{name: "successor", provider: local, revoked: "next", want: false},
+		{name: "successor held as version", provider: versions, revoked: "next", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rotatesRevoked(tt.provider, keys, map[string]bool{tt.revoked: true})
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalKeysAreNotFinalized(t *testing.T) {
+	name := types.NamespacedName{Name: "key", Namespace: "default"}
+	r, c := newTestRotatingKeyReconciler(t, &tokensv1alpha1.RotatingKey{
+		ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace},
+		Spec:       tokensv1alpha1.RotatingKeySpec{Algorithm: "ES256", Lifetime: "1h", RotateAfter: "1h"},
+	})
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: name}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := &tokensv1alpha1.RotatingKey{}
+	if err := c.Get(context.Background(), name, key); err != nil {
+		t.Fatal(err)
+	}
+	if len(key.Finalizers) != 0 {
+		t.Errorf("got finalizers %v, local keys are removed with their secret", key.Finalizers)
+	}
+}
+
+func TestKeysToStatus(t *testing.T) {
+	spec := tokensv1alpha1.RotatingKeySpec{Algorithm: "ES256", RotateAfter: "24h", Lifetime: "1h", MaxLifetime: "2h"}
+	nextRotation := time.Now().Add(time.Hour).Truncate(time.Second)
+	keys := testKeys(t, crypto.NewLocalProvider("ES256", 0), nextRotation)
+
+	status, err := KeysToStatus(keys, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signing, _ := crypto.DecodePublic(keys.SigningKey.Public())
+	if status.SigningKey.KeyID != "signing" || status.SigningKey.PublicKey != signing {
+		t.Errorf("got signing key %+v", status.SigningKey)
+	}
+	if !status.NexRotation.Time.Equal(nextRotation) {
+		t.Errorf("got next rotation %s, want %s", status.NexRotation, nextRotation)
+	}
+
+	if len(status.VerificationKeys) != 2 {
+		t.Fatalf("got verification keys %v, want the rotated and the next key", status.VerificationKeys)
+	}
+	rotated, next := status.VerificationKeys[0], status.VerificationKeys[1]
+	if rotated.KeyID != "rotated" || !rotated.ExpireAt.Time.Equal(keys.VerificationKeys[0].Expiry) {
+		t.Errorf("got rotated key %+v", rotated)
+	}
+	// The next key verifies for a rotation period and the maximum lifetime after the next rotation
+	nextPublic, _ := crypto.DecodePublic(keys.NextKey.Public())
+	if next.KeyID != "next" || next.PublicKey != nextPublic || !next.ExpireAt.Time.Equal(nextRotation.Add(26*time.Hour)) {
+		t.Errorf("got next key %+v", next)
+	}
+}
+
+func TestKeysStatusRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{"ES256", "EdDSA", "HS256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			rotatingKey := &tokensv1alpha1.RotatingKey{
+				Spec: tokensv1alpha1.RotatingKeySpec{Algorithm: algorithm, RotateAfter: "24h", Lifetime: "1h"},
+			}
+			provider := crypto.NewLocalProvider(algorithm, 0)
+			keys := testKeys(t, provider, time.Now().Add(time.Hour).Truncate(time.Second))
+
+			status, err := KeysToStatus(keys, rotatingKey.Spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret := &v1.Secret{}
+			err = keysToSecret(provider, keys, status, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			storeStringData(secret)
+			rotatingKey.Status = status
+
+			loaded, err := StatusToKeys(provider, rotatingKey, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if loaded.SigningKid != "signing" || !reflect.DeepEqual(loaded.SigningKey.Public(), keys.SigningKey.Public()) {
+				t.Errorf("signing key changed: %s", loaded.SigningKid)
+			}
+			if loaded.NextKid != "next" || loaded.NextKey == nil || !reflect.DeepEqual(loaded.NextKey.Public(), keys.NextKey.Public()) {
+				t.Errorf("next key changed: %s", loaded.NextKid)
+			}
+			if !loaded.NextRotation.Equal(keys.NextRotation) {
+				t.Errorf("got next rotation %s, want %s", loaded.NextRotation, keys.NextRotation)
+			}
+			// The next key is kept as successor, not as verification key
+			if len(loaded.VerificationKeys) != 1 {
+				t.Fatalf("got verification keys %v, want the rotated key", loaded.VerificationKeys)
+			}
+			rotated := loaded.VerificationKeys[0]
+			if rotated.Kid != "rotated" || !rotated.Expiry.Equal(keys.VerificationKeys[0].Expiry) ||
+				!reflect.DeepEqual(rotated.PublicKey, keys.VerificationKeys[0].PublicKey) {
+				t.Errorf("got rotated key %+v", rotated)
+			}
+
+			// Shared secrets are only kept in the secret
+			if crypto.IsSymmetric(keys.SigningKey.Public()) {
+				if status.SigningKey.PublicKey != "" {
+					t.Error("shared secret of the signing key in status")
+				}
+				for _, k := range status.VerificationKeys {
+					if k.PublicKey != "" {
+						t.Errorf("shared secret of %s in status", k.KeyID)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	"github.com/hexhibit-xyz/toope/crypto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// failedObject is an object whose first reconcile fails, together with the
+// condition reporting the failure.
+type failedObject struct {
+	name string
+	// Objects the reconcile reads
+	existing  []runtime.Object
+	object    runtime.Object
+	condition tokensv1alpha1.ConditionType
+	reason    string
+}
+
+func failedObjects() []failedObject {
+	return []failedObject{
+		{
+			name: "jwt of a missing key",
+			object: &tokensv1alpha1.Jwt{
+				ObjectMeta: metav1.ObjectMeta{Name: "missing-key", Namespace: "default"},
+				Spec: tokensv1alpha1.JwtSpec{
+					Subject:        "subject",
+					RotatingKeyRef: tokensv1alpha1.RotatingKeyRef{Name: "missing", Namespace: "default"},
+				},
+			},
+			condition: tokensv1alpha1.ConditionKeyAvailable,
+			reason:    tokensv1alpha1.ReasonKeyNotFound,
+		},
+		{
+			name: "jwt of a corrupt signing key",
+			existing: []runtime.Object{
+				&tokensv1alpha1.RotatingKey{
+					ObjectMeta: metav1.ObjectMeta{Name: "corrupt", Namespace: "default"},
+					Spec: tokensv1alpha1.RotatingKeySpec{
+						Algorithm:   "ES256",
+						RotateAfter: "1h",
+						Lifetime:    "1h",
+					},
+				},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "corrupt", Namespace: "default"},
+					Data:       map[string][]byte{crypto.SecretKeyPrivateKey: []byte("corrupt")},
+				},
+			},
+			object: &tokensv1alpha1.Jwt{
+				ObjectMeta: metav1.ObjectMeta{Name: "corrupt-key", Namespace: "default"},
+				Spec: tokensv1alpha1.JwtSpec{
+					Subject:        "subject",
+					RotatingKeyRef: tokensv1alpha1.RotatingKeyRef{Name: "corrupt"},
+				},
+			},
+			condition: tokensv1alpha1.ConditionSigned,
+			reason:    tokensv1alpha1.ReasonSigningFailed,
+		},
+		{
+			name: "key of an unconfigured backend",
+			object: &tokensv1alpha1.RotatingKey{
+				ObjectMeta: metav1.ObjectMeta{Name: "unconfigured", Namespace: "default"},
+				Spec: tokensv1alpha1.RotatingKeySpec{
+					Algorithm:   "ES256",
+					RotateAfter: "1h",
+					Lifetime:    "1h",
+					Backend:     tokensv1alpha1.KeyBackendPKCS11,
+				},
+			},
+			condition: tokensv1alpha1.ConditionKeyAvailable,
+			reason:    tokensv1alpha1.ReasonBackendUnavailable,
+		},
+	}
+}
+
+// reconcileFailed reconciles the object once with the client and returns it
+// as stored afterwards.
+func reconcileFailed(c client.Client, scheme *runtime.Scheme, obj runtime.Object) (runtime.Object, error) {
+	key, err := client.ObjectKeyFromObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	req := ctrl.Request{NamespacedName: key}
+	recorder := record.NewFakeRecorder(100)
+
+	stored := obj.DeepCopyObject()
+	switch obj.(type) {
+	case *tokensv1alpha1.Jwt:
+		r := &JwtReconciler{Client: c, Log: ctrl.Log, Scheme: scheme, Recorder: recorder}
+		_, err = r.Reconcile(req)
+	case *tokensv1alpha1.RotatingKey:
+		r := &RotatingKeyReconciler{Client: c, Log: ctrl.Log, Scheme: scheme, Recorder: recorder}
+		_, err = r.Reconcile(req)
+	}
+	if err == nil {
+		return nil, errors.New("reconcile did not fail")
+	}
+	return stored, c.Get(context.Background(), key, stored)
+}
+
+// failedStatus returns the conditions and the error message stored in the
+// status of obj
+func failedStatus(obj runtime.Object, conditionType tokensv1alpha1.ConditionType) (*tokensv1alpha1.Condition, string) {
+	switch o := obj.(type) {
+	case *tokensv1alpha1.Jwt:
+		return tokensv1alpha1.FindCondition(o.Status.Conditions, conditionType), o.Status.Error
+	case *tokensv1alpha1.RotatingKey:
+		condition := tokensv1alpha1.FindCondition(o.Status.Conditions, conditionType)
+		if condition == nil {
+			return nil, ""
+		}
+		return condition, condition.Message
+	}
+	return nil, ""
+}
+
+// validateSchema validates obj against the structural schema of the generated
+// CRD in file, as done by the API server.
+func validateSchema(t *testing.T, file string, obj runtime.Object) {
+	data, err := ioutil.ReadFile(filepath.Join("..", "config", "crd", "bases", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crd := &apiextensionsv1beta1.CustomResourceDefinition{}
+	if err := yaml.Unmarshal(data, crd); err != nil {
+		t.Fatal(err)
+	}
+	internal := &apiextensions.CustomResourceValidation{}
+	err = apiextensionsv1beta1.Convert_v1beta1_CustomResourceValidation_To_apiextensions_CustomResourceValidation(crd.Spec.Validation, internal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator, _, err := validation.NewSchemaValidator(internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(encoded, &object); err != nil {
+		t.Fatal(err)
+	}
+	if errs := validation.ValidateCustomResource(nil, object, validator); len(errs) > 0 {
+		t.Errorf("rejected by the schema of %s: %v", file, errs.ToAggregate())
+	}
+}
+
+// The fake client does not enforce the schema, so the status stored by a
+// failed first reconcile is checked against the CRD.
+func TestFailedStatusMatchesSchema(t *testing.T) {
+	for _, tt := range failedObjects() {
+		t.Run(tt.name, func(t *testing.T) {
+			r, c := newTestRotatingKeyReconciler(t, append(tt.existing, tt.object)...)
+
+			stored, err := reconcileFailed(c, r.Scheme, tt.object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			condition, msg := failedStatus(stored, tt.condition)
+			if condition == nil || condition.Status != corev1.ConditionFalse || condition.Reason != tt.reason {
+				t.Fatalf("got %s condition %v, want reason %s", tt.condition, condition, tt.reason)
+			}
+			if msg == "" {
+				t.Fatal("error not stored")
+			}
+
+			file := "tokens.hexhibit.xyz_jwts.yaml"
+			if _, ok := stored.(*tokensv1alpha1.RotatingKey); ok {
+				file = "tokens.hexhibit.xyz_rotatingkeys.yaml"
+			}
+			validateSchema(t, file, stored)
+		})
+	}
+}
+
+var _ = Describe("Failed first reconcile", func() {
+	for _, tt := range failedObjects() {
+		tt := tt
+		It("stores the conditions of a "+tt.name, func() {
+			for _, obj := range append(tt.existing, tt.object) {
+				Expect(k8sClient.Create(context.Background(), obj)).To(Succeed())
+			}
+
+			stored, err := reconcileFailed(k8sClient, scheme.Scheme, tt.object)
+			Expect(err).NotTo(HaveOccurred())
+			condition, msg := failedStatus(stored, tt.condition)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal(tt.reason))
+			Expect(msg).NotTo(BeEmpty())
+		})
+	}
+})
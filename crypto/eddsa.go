@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA implements the EdDSA signing method (RFC 8037) with
+// Ed25519 keys, which is not provided by jwt-go.
+type SigningMethodEdDSA struct{}
+
+var signingMethodEdDSA = &SigningMethodEdDSA{}
+
+func init() {
+	jwtgo.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwtgo.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Verify expects an ed25519.PublicKey.
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwtgo.ErrInvalidKeyType
+	}
+
+	sig, err := jwtgo.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+// Sign expects an ed25519.PrivateKey.
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwtgo.ErrInvalidKeyType
+	}
+
+	return jwtgo.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
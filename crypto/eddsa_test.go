@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+// Test vectors of RFC 8037, appendix A
+const (
+	rfc8037Seed          = "nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A"
+	rfc8037X             = "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"
+	rfc8037SigningString = "eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc"
+	rfc8037Signature     = "hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg"
+)
+
+func rfc8037Key(t *testing.T) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(decodeBase64(t, rfc8037Seed))
+}
+
+func TestEdDSASignTestVector(t *testing.T) {
+	key := rfc8037Key(t)
+
+	signature, err := signingMethodEdDSA.Sign(rfc8037SigningString, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != rfc8037Signature {
+		t.Errorf("got signature %s, want %s", signature, rfc8037Signature)
+	}
+
+	err = signingMethodEdDSA.Verify(rfc8037SigningString, rfc8037Signature, key.Public())
+	if err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestEdDSAVerifyRejects(t *testing.T) {
+	key := rfc8037Key(t)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		signingString string
+		signature     string
+		key           interface{}
+	}{
+		{name: "other key", signingString: rfc8037SigningString, signature: rfc8037Signature, key: other.Public()},
+		{name: "changed payload", signingString: rfc8037SigningString + "x", signature: rfc8037Signature, key: key.Public()},
+		{name: "invalid encoding", signingString: rfc8037SigningString, signature: "!", key: key.Public()},
+		{name: "private key", signingString: rfc8037SigningString, signature: rfc8037Signature, key: key},
+		{name: "symmetric key", signingString: rfc8037SigningString, signature: rfc8037Signature, key: []byte("secret")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := signingMethodEdDSA.Verify(tt.signingString, tt.signature, tt.key)
+			if err == nil {
+				t.Error("signature verified")
+			}
+		})
+	}
+}
+
+func TestEdDSASignRejectsOtherKeys(t *testing.T) {
+	_, err := signingMethodEdDSA.Sign(rfc8037SigningString, rfc8037Key(t).Public())
+	if err != jwtgo.ErrInvalidKeyType {
+		t.Errorf("got error %v, want %v", err, jwtgo.ErrInvalidKeyType)
+	}
+}
+
+func TestEd25519PublicJWK(t *testing.T) {
+	jwk, err := PublicJWK(rfc8037Key(t).Public(), "kid", "EdDSA", "sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.X != rfc8037X || jwk.Y != "" {
+		t.Errorf("got %+v, want OKP key with x %s", jwk, rfc8037X)
+	}
+}
+
+func TestEd25519PEMRoundTrip(t *testing.T) {
+	key := rfc8037Key(t)
+
+	private, err := decodePrivate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := encodePrivate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, key) {
+		t.Errorf("private key changed by the PEM round trip")
+	}
+
+	public, err := DecodePublic(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedPublic, err := EncodePublic(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedPublic, key.Public()) {
+		t.Errorf("public key changed by the PEM round trip")
+	}
+}
+
+func TestEdDSAToken(t *testing.T) {
+	signer := localSigner{algorithm: "EdDSA", key: rfc8037Key(t)}
+
+	token := jwtgo.NewWithClaims(jwtgo.GetSigningMethod("EdDSA"), jwtgo.MapClaims{"sub": "test"})
+	signed, err := SignToken(signer, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := jwtgo.Parse(signed, func(token *jwtgo.Token) (interface{}, error) {
+		return signer.Public(), nil
+	})
+	if err != nil || !parsed.Valid || parsed.Header["alg"] != "EdDSA" {
+		t.Errorf("token does not verify: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	v1 "k8s.io/api/core/v1"
+)
+
+const BlockTypeHMAC = "HMAC KEY"
+const SecretKeyVerificationKeys = "verification_keys"
+
+// generateHMAC creates a random shared secret of size bytes.
+func generateHMAC(size int) ([]byte, error) {
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// IsSymmetric reports if the key is a shared HMAC secret. Symmetric keys
+// verify signatures as well, so they must never be published.
+func IsSymmetric(key interface{}) bool {
+	_, ok := key.([]byte)
+	return ok
+}
+
+// VerificationKeysToSecret stores the symmetric verification keys in the
+// secret of the private key, as they can not be published in the status.
+func VerificationKeysToSecret(keys []VerificationKey, secret *v1.Secret) error {
+	symmetric := map[string][]byte{}
+	for _, k := range keys {
+		if IsSymmetric(k.PublicKey) {
+			symmetric[k.Kid] = k.PublicKey.([]byte)
+		}
+	}
+
+	if len(symmetric) == 0 && secret.Data[SecretKeyVerificationKeys] == nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(symmetric)
+	if err != nil {
+		return err
+	}
+
+	if secret.StringData == nil {
+		secret.StringData = map[string]string{}
+	}
+	secret.StringData[SecretKeyVerificationKeys] = string(encoded)
+	return nil
+}
+
+// VerificationKeysFromSecret returns the symmetric verification keys by key ID.
+func VerificationKeysFromSecret(secret *v1.Secret) (map[string][]byte, error) {
+	symmetric := map[string][]byte{}
+
+	encoded := secret.Data[SecretKeyVerificationKeys]
+	if len(encoded) == 0 {
+		return symmetric, nil
+	}
+
+	err := json.Unmarshal(encoded, &symmetric)
+	return symmetric, err
+}
@@ -0,0 +1,171 @@
+package crypto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGenerateHMACKeySize(t *testing.T) {
+	for algorithm, size := range map[string]int{"HS256": 32, "HS384": 48, "HS512": 64} {
+		t.Run(algorithm, func(t *testing.T) {
+			key, err := GenerateKey(algorithm, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsSymmetric(key) || len(key.([]byte)) != size {
+				t.Errorf("got %T of %d bytes, want %d bytes", key, len(key.([]byte)), size)
+			}
+
+			other, err := GenerateKey(algorithm, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(key.([]byte), other.([]byte)) {
+				t.Error("generated the same key twice")
+			}
+		})
+	}
+}
+
+func TestHMACKeyPEMRoundTrip(t *testing.T) {
+	key, err := GenerateKey("HS256", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := decodePrivate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := encodePrivate(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, key) {
+		t.Errorf("key changed by the PEM round trip")
+	}
+}
+
+func TestHMACKeysAreNotPublished(t *testing.T) {
+	signer, err := NewLocalProvider("HS256", 0).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DecodePublic(signer.Public()); err == nil {
+		t.Error("shared secret encoded as public key")
+	}
+	if _, err := signer.PublicJWK("kid", "sig"); err == nil {
+		t.Error("shared secret exported as JWK")
+	}
+
+	keys := Keys{
+		SigningKey:       signer,
+		SigningKid:       "signing",
+		NextKey:          signer,
+		NextKid:          "next",
+		VerificationKeys: []VerificationKey{{PublicKey: signer.Public(), Kid: "rotated", Expiry: time.Now().Add(time.Hour)}},
+	}
+	jwks, err := NewJWKS(keys, "HS256", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 0 {
+		t.Errorf("shared secrets published: %v", jwks.Keys)
+	}
+}
+
+func TestHMACSignVerify(t *testing.T) {
+	provider := NewLocalProvider("HS384", 0)
+	signer, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwtgo.NewWithClaims(jwtgo.GetSigningMethod("HS384"), jwtgo.MapClaims{"sub": "test"})
+	signed, err := SignToken(signer, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is verified with the key loaded from the secret
+	secret := &v1.Secret{}
+	err = provider.ToSecret(signer, "kid", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data = map[string][]byte{}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	loaded, err := provider.FromSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = jwtgo.Parse(signed, func(*jwtgo.Token) (interface{}, error) {
+		return loaded.Public(), nil
+	})
+	if err != nil {
+		t.Errorf("token does not verify with the stored key: %v", err)
+	}
+}
+
+func TestVerificationKeysSecretRoundTrip(t *testing.T) {
+	rsaSigner, err := NewLocalProvider("RS256", 2048).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []VerificationKey{
+		{PublicKey: []byte("first"), Kid: "first"},
+		{PublicKey: rsaSigner.Public(), Kid: "asymmetric"},
+		{PublicKey: []byte("second"), Kid: "second"},
+	}
+
+	secret := &v1.Secret{}
+	err = VerificationKeysToSecret(keys, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data = map[string][]byte{SecretKeyVerificationKeys: []byte(secret.StringData[SecretKeyVerificationKeys])}
+
+	stored, err := VerificationKeysFromSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"first": []byte("first"), "second": []byte("second")}
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("got %v, want only the symmetric keys %v", stored, want)
+	}
+
+	// Dropping the last symmetric key clears the stored keys
+	secret.StringData = nil
+	err = VerificationKeysToSecret(keys[1:2], secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.StringData[SecretKeyVerificationKeys] != "{}" {
+		t.Errorf("got stored keys %q, want none", secret.StringData[SecretKeyVerificationKeys])
+	}
+}
+
+func TestVerificationKeysSecretWithoutKeys(t *testing.T) {
+	secret := &v1.Secret{}
+	err := VerificationKeysToSecret(nil, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.StringData != nil {
+		t.Errorf("stored keys in secret without symmetric keys: %v", secret.StringData)
+	}
+
+	stored, err := VerificationKeysFromSecret(secret)
+	if err != nil || len(stored) != 0 {
+		t.Errorf("got keys %v, error %v", stored, err)
+	}
+}
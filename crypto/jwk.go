@@ -0,0 +1,117 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// JWK is a JSON Web Key (RFC 7517) holding a public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// RSA public key parameters
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Elliptic curve and octet key pair public key parameters
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWK exports the public key as JWK.
+func PublicJWK(key gocrypto.PublicKey, kid, alg, use string) (JWK, error) {
+	jwk := JWK{
+		Kid: kid,
+		Use: use,
+		Alg: alg,
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeBase64(k.N.Bytes())
+		jwk.E = encodeBase64(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// Coordinates are padded to the size of the curve (RFC 7518, section 6.2.1.2)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = k.Curve.Params().Name
+		jwk.X = encodeBase64(padded(k.X, size))
+		jwk.Y = encodeBase64(padded(k.Y, size))
+	case ed25519.PublicKey:
+		// Octet key pair (RFC 8037, section 2)
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encodeBase64(k)
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	return jwk, nil
+}
+
+// NewJWKS returns the key set of the signing key, its pre-published successor
+// and all verification keys which have not expired at now. Symmetric keys are
+// never published.
+func NewJWKS(keys Keys, algorithm string, now time.Time) (JWKS, error) {
+	jwks := JWKS{Keys: []JWK{}}
+
+	for _, signer := range []struct {
+		key Signer
+		kid string
+	}{{keys.SigningKey, keys.SigningKid}, {keys.NextKey, keys.NextKid}} {
+		if signer.key == nil || IsSymmetric(signer.key.Public()) {
+			continue
+		}
+
+		jwk, err := signer.key.PublicJWK(signer.kid, "sig")
+		if err != nil {
+			return JWKS{}, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	for _, k := range keys.VerificationKeys {
+		if IsSymmetric(k.PublicKey) || now.After(k.Expiry) {
+			continue
+		}
+
+		jwk, err := PublicJWK(k.PublicKey, k.Kid, algorithm, "sig")
+		if err != nil {
+			return JWKS{}, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks, nil
+}
+
+func padded(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	if len(b) >= size {
+		return b
+	}
+
+	p := make([]byte, size)
+	copy(p[size-len(b):], b)
+	return p
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeBase64(t *testing.T, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRSAPublicJWK(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk, err := PublicJWK(&key.PublicKey, "kid", "RS256", "sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwk.Kty != "RSA" || jwk.Kid != "kid" || jwk.Alg != "RS256" || jwk.Use != "sig" {
+		t.Errorf("got %+v", jwk)
+	}
+	// The common exponent 65537 is encoded as AQAB
+	if jwk.E != "AQAB" {
+		t.Errorf("got exponent %s, want AQAB", jwk.E)
+	}
+	if n := new(big.Int).SetBytes(decodeBase64(t, jwk.N)); n.Cmp(key.N) != 0 {
+		t.Errorf("modulus changed by encoding")
+	}
+}
+
+func TestECPublicJWK(t *testing.T) {
+	tests := []struct {
+		curve elliptic.Curve
+		crv   string
+		size  int
+	}{
+		{elliptic.P256(), "P-256", 32},
+		{elliptic.P384(), "P-384", 48},
+		{elliptic.P521(), "P-521", 66},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.crv, func(t *testing.T) {
+			// Generate keys until one has a short coordinate, to cover the padding
+			var key *ecdsa.PrivateKey
+			for i := 0; i < 1000; i++ {
+				k, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key = k
+				if len(k.X.Bytes()) < tt.size || len(k.Y.Bytes()) < tt.size {
+					break
+				}
+			}
+
+			jwk, err := PublicJWK(&key.PublicKey, "kid", "ES256", "sig")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if jwk.Kty != "EC" || jwk.Crv != tt.crv {
+				t.Errorf("got kty %s, crv %s", jwk.Kty, jwk.Crv)
+			}
+
+			x, y := decodeBase64(t, jwk.X), decodeBase64(t, jwk.Y)
+			if len(x) != tt.size || len(y) != tt.size {
+				t.Errorf("got coordinates of %d and %d bytes, want %d", len(x), len(y), tt.size)
+			}
+			if new(big.Int).SetBytes(x).Cmp(key.X) != 0 || new(big.Int).SetBytes(y).Cmp(key.Y) != 0 {
+				t.Errorf("coordinates changed by encoding")
+			}
+		})
+	}
+}
+
+func TestPublicJWKUnsupportedKey(t *testing.T) {
+	_, err := PublicJWK([]byte("secret"), "kid", "HS256", "sig")
+	if err == nil {
+		t.Fatal("symmetric key exported as JWK")
+	}
+}
+
+func TestNewJWKS(t *testing.T) {
+	now := time.Now()
+	provider := NewLocalProvider("ES256", 0)
+	generate := func() Signer {
+		signer, err := provider.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+
+	keys := Keys{
+		SigningKey: generate(),
+		SigningKid: "signing",
+		NextKey:    generate(),
+		NextKid:    "next",
+		VerificationKeys: []VerificationKey{
+			{PublicKey: generate().Public(), Kid: "rotated", Expiry: now.Add(time.Hour)},
+			{PublicKey: generate().Public(), Kid: "expired", Expiry: now.Add(-time.Second)},
+		},
+	}
+
+	jwks, err := NewJWKS(keys, "ES256", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kids []string
+	for _, jwk := range jwks.Keys {
+		kids = append(kids, jwk.Kid)
+		if jwk.Alg != "ES256" || jwk.Use != "sig" || jwk.Kty != "EC" {
+			t.Errorf("got key %+v", jwk)
+		}
+	}
+	if strings.Join(kids, ",") != "signing,next,rotated" {
+		t.Errorf("got keys %v, want signing,next,rotated", kids)
+	}
+
+	// Without keys the set is empty, not null
+	empty, err := NewJWKS(Keys{}, "ES256", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded, _ := json.Marshal(empty); string(encoded) != `{"keys":[]}` {
+		t.Errorf("got %s, want an empty key set", encoded)
+	}
+}
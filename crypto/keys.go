@@ -1,6 +1,10 @@
 package crypto
 
 import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -11,7 +15,45 @@ import (
 
 const BlockTypePrivate = "RSA PRIVATE KEY"
 const BlockTypePublic = "RSA PUBLIC KEY"
+const BlockTypeECPrivate = "EC PRIVATE KEY"
+const BlockTypePKCS8Private = "PRIVATE KEY"
+const BlockTypePKIXPublic = "PUBLIC KEY"
 const SecretKeyPrivateKey = "private_key"
+const SecretKeyKid = "kid"
+
+// DefaultRSAKeySize is used for RSA keys if no key size is set
+const DefaultRSAKeySize = 2048
+
+// GenerateKey creates a new private key for the JWS algorithm. The key size
+// is only used for RSA keys, the size of all other keys is given by the
+// algorithm. HMAC keys are returned as []byte, all others as crypto.Signer.
+func GenerateKey(algorithm string, keySize int) (gocrypto.PrivateKey, error) {
+	if keySize == 0 {
+		keySize = DefaultRSAKeySize
+	}
+
+	switch algorithm {
+	case "", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		return rsa.GenerateKey(rand.Reader, keySize)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "HS256":
+		return generateHMAC(32)
+	case "HS384":
+		return generateHMAC(48)
+	case "HS512":
+		return generateHMAC(64)
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %s", algorithm)
+}
 
 func decodeRSA(key *rsa.PrivateKey) (private string, public string) {
 	public = string(pem.EncodeToMemory(
@@ -31,6 +73,49 @@ func decodeRSA(key *rsa.PrivateKey) (private string, public string) {
 	return
 }
 
+// decodePrivate encodes the private key as PEM, RSA keys as PKCS#1, ECDSA
+// keys as SEC1, Ed25519 keys as PKCS#8 and HMAC keys as raw bytes.
+func decodePrivate(key gocrypto.PrivateKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		private, _ := decodeRSA(k)
+		return private, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: BlockTypeECPrivate, Bytes: der})), nil
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: BlockTypePKCS8Private, Bytes: der})), nil
+	case []byte:
+		return string(pem.EncodeToMemory(&pem.Block{Type: BlockTypeHMAC, Bytes: k})), nil
+	}
+
+	return "", fmt.Errorf("unsupported private key type %T", key)
+}
+
+// DecodePublic encodes the public key as PEM, RSA keys as PKCS#1 and all
+// others as PKIX. Symmetric keys are rejected.
+func DecodePublic(key gocrypto.PublicKey) (string, error) {
+	if k, ok := key.(*rsa.PublicKey); ok {
+		return DecodeRSAPublic(*k), nil
+	}
+	if IsSymmetric(key) {
+		return "", fmt.Errorf("symmetric keys can not be published")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: BlockTypePKIXPublic, Bytes: der})), nil
+}
+
 func DecodeRSAPublic(key rsa.PublicKey) (public string) {
 	public = string(pem.EncodeToMemory(
 		&pem.Block{
@@ -42,45 +127,59 @@ func DecodeRSAPublic(key rsa.PublicKey) (public string) {
 	return
 }
 
-func EncodePublicRSA(public string) (*rsa.PublicKey, error) {
+// EncodePublic parses a PEM encoded PKCS#1 or PKIX public key.
+func EncodePublic(public string) (gocrypto.PublicKey, error) {
 
 	block, _ := pem.Decode([]byte(public))
-	if block == nil || block.Type != BlockTypePublic {
+	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block containing public key")
 	}
 
-	return x509.ParsePKCS1PublicKey(block.Bytes)
+	switch block.Type {
+	case BlockTypePublic:
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case BlockTypePKIXPublic:
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
 }
 
-func encodeRSA(private string) (*rsa.PrivateKey, error) {
+// encodePrivate parses a PEM encoded PKCS#1, SEC1, PKCS#8 or HMAC private key.
+func encodePrivate(private string) (gocrypto.PrivateKey, error) {
 
 	block, _ := pem.Decode([]byte(private))
-	if block == nil || block.Type != BlockTypePrivate {
+	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block containing private key")
 	}
 
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
-}
-
-func FromSecret(secret *v1.Secret) (*rsa.PrivateKey, error) {
-	privatePem := secret.Data[SecretKeyPrivateKey]
-	return encodeRSA(string(privatePem))
-}
-
-func ToSecret(key *rsa.PrivateKey, secret *v1.Secret) {
-	priv, _ := decodeRSA(key)
-	DecodedToSecret(priv, secret)
-}
+	switch block.Type {
+	case BlockTypePrivate:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case BlockTypeECPrivate:
+		return x509.ParseECPrivateKey(block.Bytes)
+	case BlockTypeHMAC:
+		return block.Bytes, nil
+	case BlockTypePKCS8Private:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(gocrypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
 
-func DecodedToSecret(private string, secret *v1.Secret) {
-	secret.StringData = map[string]string{SecretKeyPrivateKey: private}
+	return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
 }
 
-func CreateKeys() (private, public string, err error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return
+// DecodedToSecret stores the private key together with its key ID, so a token
+// is always signed with the key matching the kid header.
+func DecodedToSecret(private string, kid string, secret *v1.Secret) {
+	secret.StringData = map[string]string{
+		SecretKeyPrivateKey: private,
+		SecretKeyKid:        kid,
 	}
-	private, public = decodeRSA(key)
-	return
 }
@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrivateKeyPEMRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "ES256", "ES384", "ES512"} {
+		t.Run(algorithm, func(t *testing.T) {
+			key, err := GenerateKey(algorithm, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			private, err := decodePrivate(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := encodePrivate(private)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, key) {
+				t.Errorf("private key changed by the PEM round trip")
+			}
+		})
+	}
+}
+
+func TestPublicKeyPEMRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "ES256", "ES384", "ES512"} {
+		t.Run(algorithm, func(t *testing.T) {
+			signer, err := NewLocalProvider(algorithm, 2048).Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			public, err := DecodePublic(signer.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := EncodePublic(public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, signer.Public()) {
+				t.Errorf("public key changed by the PEM round trip")
+			}
+		})
+	}
+}
+
+func TestInvalidPEM(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"not a key",
+		"-----BEGIN CERTIFICATE-----\nMA==\n-----END CERTIFICATE-----\n",
+	} {
+		if _, err := encodePrivate(value); err == nil {
+			t.Errorf("private key decoded from %q", value)
+		}
+		if _, err := EncodePublic(value); err == nil {
+			t.Errorf("public key decoded from %q", value)
+		}
+	}
+}
+
+func TestGenerateKeyUnsupportedAlgorithm(t *testing.T) {
+	_, err := GenerateKey("none", 0)
+	if err == nil {
+		t.Fatal("key generated for unsupported algorithm")
+	}
+}
@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	v1 "k8s.io/api/core/v1"
+)
+
+// localProvider keeps the private key PEM encoded in the secret.
+type localProvider struct {
+	algorithm string
+	keySize   int
+}
+
+// localSigner signs with a private key held in memory.
+type localSigner struct {
+	algorithm string
+	key       gocrypto.PrivateKey
+}
+
+// NewLocalProvider returns a provider for keys of the JWS algorithm, which are
+// stored in the secret. The key size is only used for RSA keys.
+func NewLocalProvider(algorithm string, keySize int) KeyProvider {
+	return localProvider{
+		algorithm: algorithm,
+		keySize:   keySize,
+	}
+}
+
+func (p localProvider) Generate() (Signer, error) {
+	key, err := GenerateKey(p.algorithm, p.keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return localSigner{algorithm: p.algorithm, key: key}, nil
+}
+
+func (p localProvider) FromSecret(secret *v1.Secret) (Signer, error) {
+	privatePem := secret.Data[SecretKeyPrivateKey]
+	key, err := encodePrivate(string(privatePem))
+	if err != nil {
+		return nil, err
+	}
+
+	return localSigner{algorithm: p.algorithm, key: key}, nil
+}
+
+func (p localProvider) ToSecret(signer Signer, kid string, secret *v1.Secret) error {
+	local, ok := signer.(localSigner)
+	if !ok {
+		return fmt.Errorf("unsupported signer %T", signer)
+	}
+
+	private, err := decodePrivate(local.key)
+	if err != nil {
+		return err
+	}
+
+	DecodedToSecret(private, kid, secret)
+	return nil
+}
+
+func (s localSigner) Algorithm() string {
+	return s.algorithm
+}
+
+func (s localSigner) Sign(signingString string) (string, error) {
+	method := jwtgo.GetSigningMethod(s.algorithm)
+	if method == nil {
+		return "", fmt.Errorf("unsupported algorithm %s", s.algorithm)
+	}
+
+	// jwt-go signs with the maximum salt length, RFC 7518 requires the salt
+	// to be as long as the hash
+	if pss, ok := method.(*jwtgo.SigningMethodRSAPSS); ok {
+		return signPSS(signingString, s.key, pss.Hash)
+	}
+
+	return method.Sign(signingString, s.key)
+}
+
+// signPSS signs with RSASSA-PSS, using a salt of the hash length.
+func signPSS(signingString string, key gocrypto.PrivateKey, hash gocrypto.Hash) (string, error) {
+	private, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return "", jwtgo.ErrInvalidKeyType
+	}
+
+	digest := hash.New()
+	digest.Write([]byte(signingString))
+
+	sig, err := rsa.SignPSS(rand.Reader, private, hash, digest.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return "", err
+	}
+	return jwtgo.EncodeSegment(sig), nil
+}
+
+func (s localSigner) Public() gocrypto.PublicKey {
+	switch k := s.key.(type) {
+	case gocrypto.Signer:
+		return k.Public()
+	case []byte:
+		return k
+	}
+	return nil
+}
+
+func (s localSigner) PublicJWK(kid, use string) (JWK, error) {
+	return PublicJWK(s.Public(), kid, s.algorithm, use)
+}
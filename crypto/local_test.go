@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+func TestLocalSignerSignsPSSWithHashLengthSalt(t *testing.T) {
+	for _, algorithm := range []string{"PS256", "PS384", "PS512"} {
+		t.Run(algorithm, func(t *testing.T) {
+			signer, err := NewLocalProvider(algorithm, 2048).Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := jwtgo.NewWithClaims(jwtgo.GetSigningMethod(algorithm), jwtgo.MapClaims{"sub": "test"})
+			signed, err := SignToken(signer, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := jwtgo.Parse(signed, func(*jwtgo.Token) (interface{}, error) {
+				return signer.Public(), nil
+			})
+			if err != nil || !parsed.Valid {
+				t.Fatalf("token does not verify: %v", err)
+			}
+
+			// Strict verifiers only accept a salt of the hash length
+			method := jwtgo.GetSigningMethod(algorithm).(*jwtgo.SigningMethodRSAPSS)
+			dot := strings.LastIndex(signed, ".")
+			signingString := signed[:dot]
+			sig, err := jwtgo.DecodeSegment(signed[dot+1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := method.Hash.New()
+			digest.Write([]byte(signingString))
+			err = rsa.VerifyPSS(signer.Public().(*rsa.PublicKey), method.Hash, digest.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+			if err != nil {
+				t.Fatalf("salt length is not the hash length: %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalSignerSignVerify(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA", "HS256", "HS384", "HS512"} {
+		t.Run(algorithm, func(t *testing.T) {
+			provider := NewLocalProvider(algorithm, 2048)
+			signer, err := provider.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := jwtgo.NewWithClaims(jwtgo.GetSigningMethod(algorithm), jwtgo.MapClaims{"sub": "test"})
+			signed, err := SignToken(signer, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = jwtgo.Parse(signed, func(*jwtgo.Token) (interface{}, error) {
+				return signer.Public(), nil
+			})
+			if err != nil {
+				t.Fatalf("token does not verify: %v", err)
+			}
+
+			other, err := provider.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = jwtgo.Parse(signed, func(*jwtgo.Token) (interface{}, error) {
+				return other.Public(), nil
+			})
+			if err == nil {
+				t.Fatal("token verifies with another key")
+			}
+		})
+	}
+}
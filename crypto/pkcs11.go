@@ -0,0 +1,18 @@
+package crypto
+
+// SecretKeyPKCS11Label holds the label of the key objects in the PKCS#11
+// token. The private key itself never leaves the token.
+const SecretKeyPKCS11Label = "pkcs11_label"
+
+// PKCS11Config selects the PKCS#11 module and token holding the keys of the
+// pkcs11 backend.
+type PKCS11Config struct {
+	// Path of the PKCS#11 module (shared library) to load
+	Module string
+
+	// Label of the token holding the keys
+	TokenLabel string
+
+	// User PIN of the token
+	Pin string
+}
@@ -0,0 +1,428 @@
+//go:build cgo
+// +build cgo
+
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/miekg/pkcs11"
+	v1 "k8s.io/api/core/v1"
+	rand2 "k8s.io/apimachinery/pkg/util/rand"
+)
+
+// A module can only be initialized once per process, so loaded modules are
+// shared by all providers.
+var (
+	pkcs11Lock    sync.Mutex
+	pkcs11Modules = map[string]*pkcs11.Ctx{}
+)
+
+// Named curves of the ECDSA algorithms (RFC 5480, section 2.1.1.1)
+var pkcs11Curves = map[string]struct {
+	curve elliptic.Curve
+	oid   asn1.ObjectIdentifier
+}{
+	"ES256": {elliptic.P256(), asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}},
+	"ES384": {elliptic.P384(), asn1.ObjectIdentifier{1, 3, 132, 0, 34}},
+	"ES512": {elliptic.P521(), asn1.ObjectIdentifier{1, 3, 132, 0, 35}},
+}
+
+// pkcs11Provider generates the keys inside a PKCS#11 token and only stores
+// their label in the secret.
+type pkcs11Provider struct {
+	ctx       *pkcs11.Ctx
+	slot      uint
+	pin       string
+	algorithm string
+	keySize   int
+}
+
+// pkcs11Signer signs with a private key held by a PKCS#11 token.
+type pkcs11Signer struct {
+	provider pkcs11Provider
+	label    string
+	public   gocrypto.PublicKey
+}
+
+// NewPKCS11Provider returns a provider for keys of the JWS algorithm, which
+// are held by the PKCS#11 token. Only RSA and ECDSA algorithms are supported.
+func NewPKCS11Provider(config PKCS11Config, algorithm string, keySize int) (KeyProvider, error) {
+	_, _, err := pkcs11SignMechanism(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if keySize == 0 {
+		keySize = DefaultRSAKeySize
+	}
+
+	ctx, err := loadPKCS11(config.Module)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, err := pkcs11Slot(ctx, config.TokenLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs11Provider{
+		ctx:       ctx,
+		slot:      slot,
+		pin:       config.Pin,
+		algorithm: algorithm,
+		keySize:   keySize,
+	}, nil
+}
+
+func loadPKCS11(module string) (*pkcs11.Ctx, error) {
+	pkcs11Lock.Lock()
+	defer pkcs11Lock.Unlock()
+
+	if ctx, ok := pkcs11Modules[module]; ok {
+		return ctx, nil
+	}
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load pkcs11 module %s", module)
+	}
+
+	err := ctx.Initialize()
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize pkcs11 module %s: %v", module, err)
+	}
+
+	pkcs11Modules[module] = ctx
+	return ctx, nil
+}
+
+// pkcs11Slot returns the slot of the token with the label.
+func pkcs11Slot(ctx *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		if strings.TrimSpace(info.Label) == tokenLabel {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pkcs11 token %s not found", tokenLabel)
+}
+
+// pkcs11SignMechanism returns the signing mechanism of the JWS algorithm. If
+// the hash is set, the module only signs the digest, which has to be computed
+// beforehand.
+func pkcs11SignMechanism(algorithm string) ([]*pkcs11.Mechanism, gocrypto.Hash, error) {
+	var mechanism *pkcs11.Mechanism
+	var hash gocrypto.Hash
+
+	switch algorithm {
+	case "RS256":
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil)
+	case "RS384":
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_SHA384_RSA_PKCS, nil)
+	case "RS512":
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_SHA512_RSA_PKCS, nil)
+	// The salt is as long as the hash (RFC 7518, section 3.5)
+	case "PS256":
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS_PSS,
+			pkcs11.NewPSSParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, 32))
+	case "PS384":
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_SHA384_RSA_PKCS_PSS,
+			pkcs11.NewPSSParams(pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384, 48))
+	case "PS512":
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_SHA512_RSA_PKCS_PSS,
+			pkcs11.NewPSSParams(pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512, 64))
+	// Combined ECDSA and hash mechanisms are not supported by all modules
+	case "ES256":
+		mechanism, hash = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), gocrypto.SHA256
+	case "ES384":
+		mechanism, hash = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), gocrypto.SHA384
+	case "ES512":
+		mechanism, hash = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), gocrypto.SHA512
+	default:
+		return nil, 0, fmt.Errorf("unsupported pkcs11 algorithm %s", algorithm)
+	}
+
+	return []*pkcs11.Mechanism{mechanism}, hash, nil
+}
+
+// session opens a logged in session. The login is shared by all sessions of
+// the process, so the user is never logged out.
+func (p pkcs11Provider) session() (pkcs11.SessionHandle, error) {
+	session, err := p.ctx.OpenSession(p.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return 0, err
+	}
+
+	err = p.ctx.Login(session, pkcs11.CKU_USER, p.pin)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		_ = p.ctx.CloseSession(session)
+		return 0, fmt.Errorf("failed to login to pkcs11 token: %v", err)
+	}
+
+	return session, nil
+}
+
+func (p pkcs11Provider) Generate() (Signer, error) {
+	session, err := p.session()
+	if err != nil {
+		return nil, err
+	}
+	defer p.ctx.CloseSession(session)
+
+	label := "toope-" + rand2.String(20)
+
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(label)),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	}
+	// The private key can not be read from the token
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(label)),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	}
+
+	var mechanism *pkcs11.Mechanism
+	if curve, ok := pkcs11Curves[p.algorithm]; ok {
+		params, err := asn1.Marshal(curve.oid)
+		if err != nil {
+			return nil, err
+		}
+
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+		private = append(private, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC))
+	} else {
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, p.keySize),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+		private = append(private, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA))
+	}
+
+	publicHandle, _, err := p.ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{mechanism}, public, private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate pkcs11 key: %v", err)
+	}
+
+	pub, err := p.publicKey(session, publicHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs11Signer{provider: p, label: label, public: pub}, nil
+}
+
+func (p pkcs11Provider) FromSecret(secret *v1.Secret) (Signer, error) {
+	label := string(secret.Data[SecretKeyPKCS11Label])
+	if label == "" {
+		return nil, fmt.Errorf("no pkcs11 key label found in secret %s", secret.Name)
+	}
+
+	session, err := p.session()
+	if err != nil {
+		return nil, err
+	}
+	defer p.ctx.CloseSession(session)
+
+	handles, err := p.findObjects(session, pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, fmt.Errorf("pkcs11 key %s: %w", label, errKeyNotFound)
+	}
+
+	pub, err := p.publicKey(session, handles[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs11Signer{provider: p, label: label, public: pub}, nil
+}
+
+func (p pkcs11Provider) ToSecret(signer Signer, kid string, secret *v1.Secret) error {
+	s, ok := signer.(pkcs11Signer)
+	if !ok {
+		return fmt.Errorf("unsupported signer %T", signer)
+	}
+
+	secret.StringData = map[string]string{
+		SecretKeyPKCS11Label: s.label,
+		SecretKeyKid:         kid,
+	}
+	return nil
+}
+
+// Destroy removes the key objects of a rotated signing key from the token.
+// The public key stays available in the status for verification.
+func (p pkcs11Provider) Destroy(signer Signer) error {
+	s, ok := signer.(pkcs11Signer)
+	if !ok {
+		return fmt.Errorf("unsupported signer %T", signer)
+	}
+
+	session, err := p.session()
+	if err != nil {
+		return err
+	}
+	defer p.ctx.CloseSession(session)
+
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		handles, err := p.findObjects(session, class, s.label)
+		if err != nil {
+			return err
+		}
+		for _, handle := range handles {
+			err = p.ctx.DestroyObject(session, handle)
+			if err != nil {
+				return fmt.Errorf("failed to destroy pkcs11 key %s: %v", s.label, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p pkcs11Provider) findObjects(session pkcs11.SessionHandle, class uint, label string) ([]pkcs11.ObjectHandle, error) {
+	err := p.ctx.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	handles, _, err := p.ctx.FindObjects(session, 10)
+	finalErr := p.ctx.FindObjectsFinal(session)
+	if err != nil {
+		return nil, err
+	}
+	return handles, finalErr
+}
+
+// publicKey reads the public key object of the algorithm from the token.
+func (p pkcs11Provider) publicKey(session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (gocrypto.PublicKey, error) {
+	if curve, ok := pkcs11Curves[p.algorithm]; ok {
+		attributes, err := p.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// The point is DER encoded as octet string, some modules omit the encoding
+		point := attributes[0].Value
+		var raw []byte
+		if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+			point = raw
+		}
+
+		x, y := elliptic.Unmarshal(curve.curve, point)
+		if x == nil {
+			return nil, fmt.Errorf("invalid pkcs11 ec point")
+		}
+		return &ecdsa.PublicKey{Curve: curve.curve, X: x, Y: y}, nil
+	}
+
+	attributes, err := p.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attributes[0].Value),
+		E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+	}, nil
+}
+
+func (s pkcs11Signer) Algorithm() string {
+	return s.provider.algorithm
+}
+
+func (s pkcs11Signer) Sign(signingString string) (string, error) {
+	mechanism, hash, err := pkcs11SignMechanism(s.provider.algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	p := s.provider
+	session, err := p.session()
+	if err != nil {
+		return "", err
+	}
+	defer p.ctx.CloseSession(session)
+
+	handles, err := p.findObjects(session, pkcs11.CKO_PRIVATE_KEY, s.label)
+	if err != nil {
+		return "", err
+	}
+	if len(handles) == 0 {
+		return "", fmt.Errorf("pkcs11 key %s not found", s.label)
+	}
+
+	message := []byte(signingString)
+	if hash != 0 {
+		h := hash.New()
+		h.Write(message)
+		message = h.Sum(nil)
+	}
+
+	err = p.ctx.SignInit(session, mechanism, handles[0])
+	if err != nil {
+		return "", err
+	}
+
+	// ECDSA signatures are returned as r || s, just as JWS expects them
+	signature, err := p.ctx.Sign(session, message)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign with pkcs11 key %s: %v", s.label, err)
+	}
+
+	return jwtgo.EncodeSegment(signature), nil
+}
+
+func (s pkcs11Signer) Public() gocrypto.PublicKey {
+	return s.public
+}
+
+func (s pkcs11Signer) PublicJWK(kid, use string) (JWK, error) {
+	return PublicJWK(s.public, kid, s.provider.algorithm, use)
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+// +build !cgo
+
+package crypto
+
+import (
+	"fmt"
+)
+
+// NewPKCS11Provider fails, as PKCS#11 modules can only be loaded by binaries
+// built with cgo.
+func NewPKCS11Provider(config PKCS11Config, algorithm string, keySize int) (KeyProvider, error) {
+	return nil, fmt.Errorf("pkcs11 backend requires a binary built with cgo")
+}
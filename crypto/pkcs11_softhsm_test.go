@@ -0,0 +1,168 @@
+//go:build cgo && softhsm
+// +build cgo,softhsm
+
+package crypto
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/miekg/pkcs11"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The tests run against SoftHSM, e.g.
+//
+//	go test -tags softhsm ./crypto/
+//
+// SOFTHSM2_MODULE overrides the path of the module.
+const (
+	softHSMTokenLabel = "toope-test"
+	softHSMPin        = "1234"
+)
+
+// softHSMConfig initializes a SoftHSM token in a temporary directory.
+func softHSMConfig(t *testing.T) PKCS11Config {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		module = "/usr/lib/softhsm/libsofthsm2.so"
+	}
+	if _, err := os.Stat(module); err != nil {
+		t.Skipf("softhsm module not found: %v", err)
+	}
+
+	// The module reads its configuration once it is loaded
+	if _, ok := pkcs11Modules[module]; !ok {
+		dir, err := ioutil.TempDir("", "softhsm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := filepath.Join(dir, "softhsm2.conf")
+		err = ioutil.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", dir)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("SOFTHSM2_CONF", conf)
+
+		ctx, err := loadPKCS11(module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		initSoftHSMToken(t, ctx)
+	}
+
+	return PKCS11Config{Module: module, TokenLabel: softHSMTokenLabel, Pin: softHSMPin}
+}
+
+func initSoftHSMToken(t *testing.T, ctx *pkcs11.Ctx) {
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no softhsm slot: %v", err)
+	}
+
+	err = ctx.InitToken(slots[0], softHSMPin, softHSMTokenLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is moved to a new slot once initialized
+	slot, err := pkcs11Slot(ctx, softHSMTokenLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+
+	err = ctx.Login(session, pkcs11.CKU_SO, softHSMPin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Logout(session)
+
+	err = ctx.InitPIN(session, softHSMPin)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPKCS11GenerateSignDestroy(t *testing.T) {
+	config := softHSMConfig(t)
+
+	for _, algorithm := range []string{"RS256", "RS512", "PS256", "PS384", "ES256", "ES384", "ES512"} {
+		t.Run(algorithm, func(t *testing.T) {
+			provider, err := NewPKCS11Provider(config, algorithm, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := provider.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			secret := &v1.Secret{}
+			err = provider.ToSecret(signer, "kid", secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret.Data = map[string][]byte{}
+			for k, v := range secret.StringData {
+				secret.Data[k] = []byte(v)
+			}
+
+			loaded, err := provider.FromSecret(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := jwtgo.NewWithClaims(jwtgo.GetSigningMethod(algorithm), jwtgo.MapClaims{"sub": "test"})
+			signed, err := SignToken(loaded, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = jwtgo.Parse(signed, func(*jwtgo.Token) (interface{}, error) {
+				return signer.Public(), nil
+			})
+			if err != nil {
+				t.Fatalf("token does not verify: %v", err)
+			}
+
+			// PSS signatures use a salt of the hash length
+			if method, ok := jwtgo.GetSigningMethod(algorithm).(*jwtgo.SigningMethodRSAPSS); ok {
+				dot := strings.LastIndex(signed, ".")
+				sig, err := jwtgo.DecodeSegment(signed[dot+1:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				digest := method.Hash.New()
+				digest.Write([]byte(signed[:dot]))
+				err = rsa.VerifyPSS(signer.Public().(*rsa.PublicKey), method.Hash, digest.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+				if err != nil {
+					t.Fatalf("salt length is not the hash length: %v", err)
+				}
+			}
+
+			err = provider.(KeyDestroyer).Destroy(loaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = provider.FromSecret(secret)
+			if !IsKeyNotFound(err) {
+				t.Fatalf("destroyed key still found: %v", err)
+			}
+			_, err = loaded.Sign("test")
+			if err == nil {
+				t.Fatal("destroyed key still signs")
+			}
+		})
+	}
+}
@@ -1,8 +1,8 @@
 package crypto
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	gocrypto "crypto"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	rand2 "k8s.io/apimachinery/pkg/util/rand"
@@ -12,12 +12,17 @@ import (
 // Keys hold encryption and signing keys.
 type Keys struct {
 	// Key for creating and verifying signatures. These may be nil.
-	SigningKey *rsa.PrivateKey
+	SigningKey Signer
 	SigningKid string
 	// Old signing keys which have been rotated but can still be used to validate
 	// existing signatures.
 	VerificationKeys []VerificationKey
 
+	// Pre-published successor of the signing key, promoted at the next
+	// rotation. It may be nil.
+	NextKey Signer
+	NextKid string
+
 	// The next time the signing keyGenFunc will rotate.
 	//
 	// For caching purposes, implementations MUST NOT update keys before this time.
@@ -25,9 +30,9 @@ type Keys struct {
 }
 
 // VerificationKey is a rotated signing keyGenFunc which can still be used to verify
-// signatures.
+// signatures. The public key of symmetric keys is the shared secret.
 type VerificationKey struct {
-	PublicKey rsa.PublicKey
+	PublicKey gocrypto.PublicKey
 	Expiry    time.Time
 	Kid       string
 }
@@ -47,14 +52,11 @@ type rotationStrategy struct {
 	// signatues?
 	idTokenValidFor time.Duration
 
-	algorithm string
-}
-
-type AsymmetricAlg interface {
-	Public() AsymmetricAlg
+	// Generates the new signing keys
+	provider KeyProvider
 }
 
-func NewRotationStrategy(algorithm string, rotationFrequency, idTokenValidFor string) (rotationStrategy, error) {
+func NewRotationStrategy(provider KeyProvider, rotationFrequency, idTokenValidFor string) (rotationStrategy, error) {
 
 	rf, err := time.ParseDuration(rotationFrequency)
 	if err != nil {
@@ -69,7 +71,7 @@ func NewRotationStrategy(algorithm string, rotationFrequency, idTokenValidFor st
 	return rotationStrategy{
 		rotationFrequency: rf,
 		idTokenValidFor:   validFor,
-		algorithm:         algorithm,
+		provider:          provider,
 	}, nil
 }
 
@@ -80,25 +82,58 @@ func NewRotater(strategy rotationStrategy) keyRotater {
 	}
 }
 
+// Prepare generates the successor of the signing key, so it can be published
+// before it is used for signing. An existing successor is kept.
+func (k keyRotater) Prepare(keys *Keys) error {
+	if keys.NextKey != nil {
+		return nil
+	}
+
+	key, err := k.strategy.provider.Generate()
+	if err != nil {
+		return fmt.Errorf("generate keyGenFunc: %v", err)
+	}
+
+	keys.NextKey = key
+	keys.NextKid = rand2.String(20)
+
+	k.logger.Infof("next key %s prepared, rotation: %s", keys.NextKid, keys.NextRotation)
+
+	return nil
+}
+
+// ErrRotationNotDue is returned by Rotate before the next rotation, as the
+// keys may have been rotated already by someone else.
+var ErrRotationNotDue = errors.New("rotation not due yet")
+
+// Rotate rotates the keys once the next rotation is due.
 func (k keyRotater) Rotate(keys *Keys) error {
+	if time.Now().Before(keys.NextRotation) {
+		return ErrRotationNotDue
+	}
+
 	k.logger.Infof("keys expired, rotating")
+	return k.rotate(keys)
+}
 
-	// Generate the keyGenFunc outside of a storage transaction.
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// ForceRotate rotates the keys right away, e.g. if the signing key was
+// compromised.
+func (k keyRotater) ForceRotate(keys *Keys) error {
+	k.logger.Infof("forced rotation")
+	return k.rotate(keys)
+}
 
+func (k keyRotater) rotate(keys *Keys) error {
+	// A prepared successor is promoted, otherwise a new key is generated
+	err := k.Prepare(keys)
 	if err != nil {
-		return fmt.Errorf("generate keyGenFunc: %v", err)
+		return err
 	}
+	key, kid := keys.NextKey, keys.NextKid
 
 	var nextRotation time.Time
 	tNow := time.Now()
 
-	// if you are running multiple instances of dex, another instance
-	// could have already rotated the keys.
-	if tNow.Before(keys.NextRotation) {
-		k.logger.Error("FUCK WHAT NOW?")
-	}
-
 	expired := func(key VerificationKey) bool {
 		return tNow.After(key.Expiry)
 	}
@@ -112,11 +147,11 @@ func (k keyRotater) Rotate(keys *Keys) error {
 	}
 	keys.VerificationKeys = keys.VerificationKeys[:i]
 
-	if keys.SigningKey.PublicKey.Size() > 0 {
+	if keys.SigningKey != nil {
 		// Move current signing keyGenFunc to a verification only keyGenFunc, throwing
 		// away the private part.
 		verificationKey := VerificationKey{
-			PublicKey: keys.SigningKey.PublicKey,
+			PublicKey: keys.SigningKey.Public(),
 			// After demoting the signing keyGenFunc, keep the token around for at least
 			// the amount of time an ID Token is valid for. This ensures the
 			// verification keyGenFunc won't expire until all ID Tokens it's signed
@@ -127,12 +162,41 @@ func (k keyRotater) Rotate(keys *Keys) error {
 		keys.VerificationKeys = append(keys.VerificationKeys, verificationKey)
 	}
 
-	keys.SigningKid = rand2.String(20)
+	keys.SigningKid = kid
 	nextRotation = time.Now().Add(k.strategy.rotationFrequency)
 	keys.SigningKey = key
+	keys.NextKey = nil
+	keys.NextKid = ""
 	keys.NextRotation = nextRotation
 
 	k.logger.Infof("keys rotated, next rotation: %s", nextRotation)
 
 	return nil
 }
+
+// Revoke drops the verification keys and the successor with one of the key
+// IDs right away instead of waiting for their expiry. A revoked signing key
+// has to be rotated first, so it is demoted to a verification key before it
+// can be dropped. Revoke reports if any key was dropped.
+func Revoke(keys *Keys, kids map[string]bool) bool {
+	changed := false
+
+	if keys.NextKey != nil && kids[keys.NextKid] {
+		keys.NextKey = nil
+		keys.NextKid = ""
+		changed = true
+	}
+
+	i := 0
+	for _, key := range keys.VerificationKeys {
+		if kids[key.Kid] {
+			changed = true
+			continue
+		}
+		keys.VerificationKeys[i] = key
+		i++
+	}
+	keys.VerificationKeys = keys.VerificationKeys[:i]
+
+	return changed
+}
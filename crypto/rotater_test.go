@@ -0,0 +1,222 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRotater(t *testing.T) (keyRotater, KeyProvider) {
+	provider := NewLocalProvider("ES256", 0)
+	strategy, err := NewRotationStrategy(provider, "1h", "30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRotater(strategy), provider
+}
+
+func testKeys(t *testing.T, provider KeyProvider, nextRotation time.Time) Keys {
+	signer, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Keys{SigningKey: signer, SigningKid: "signing", NextRotation: nextRotation}
+}
+
+func TestPrepare(t *testing.T) {
+	rotater, provider := testRotater(t)
+	nextRotation := time.Now().Add(time.Minute)
+	keys := testKeys(t, provider, nextRotation)
+
+	err := rotater.Prepare(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.NextKey == nil || keys.NextKid == "" {
+		t.Fatal("next key not prepared")
+	}
+	if keys.SigningKid != "signing" || !keys.NextRotation.Equal(nextRotation) {
+		t.Fatal("preparing changed the signing key")
+	}
+
+	// A prepared key is kept
+	next, nextKid := keys.NextKey, keys.NextKid
+	err = rotater.Prepare(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.NextKey != next || keys.NextKid != nextKid {
+		t.Fatal("prepared key replaced")
+	}
+}
+
+func TestRotatePromotesPreparedKey(t *testing.T) {
+	rotater, provider := testRotater(t)
+	keys := testKeys(t, provider, time.Now().Add(-time.Second))
+	signing := keys.SigningKey
+
+	err := rotater.Prepare(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, nextKid := keys.NextKey, keys.NextKid
+
+	err = rotater.Rotate(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.SigningKey != next || keys.SigningKid != nextKid {
+		t.Fatal("prepared key not promoted")
+	}
+	if keys.NextKey != nil || keys.NextKid != "" {
+		t.Fatal("promoted key kept as next key")
+	}
+	if len(keys.VerificationKeys) != 1 || keys.VerificationKeys[0].Kid != "signing" || keys.VerificationKeys[0].PublicKey != signing.Public() {
+		t.Fatalf("rotated key not kept for verification: %+v", keys.VerificationKeys)
+	}
+	if until := time.Until(keys.VerificationKeys[0].Expiry); until < 29*time.Minute || until > 30*time.Minute {
+		t.Errorf("rotated key expires in %s, want the token lifetime", until)
+	}
+	if until := time.Until(keys.NextRotation); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("next rotation in %s, want the rotation period", until)
+	}
+}
+
+func TestRotateGeneratesWithoutPreparedKey(t *testing.T) {
+	rotater, provider := testRotater(t)
+	keys := testKeys(t, provider, time.Now().Add(-time.Second))
+
+	err := rotater.Rotate(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.SigningKid == "signing" || keys.SigningKid == "" {
+		t.Fatalf("signing key not rotated: %s", keys.SigningKid)
+	}
+}
+
+func TestRotateNotDue(t *testing.T) {
+	rotater, provider := testRotater(t)
+	keys := testKeys(t, provider, time.Now().Add(time.Minute))
+
+	err := rotater.Rotate(&keys)
+	if err != ErrRotationNotDue {
+		t.Fatalf("err = %v, want %v", err, ErrRotationNotDue)
+	}
+	if keys.SigningKid != "signing" {
+		t.Fatal("key rotated before it was due")
+	}
+
+	err = rotater.ForceRotate(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.SigningKid == "signing" {
+		t.Fatal("forced rotation did not rotate")
+	}
+}
+
+func TestRotateDropsExpiredVerificationKeys(t *testing.T) {
+	rotater, provider := testRotater(t)
+	keys := testKeys(t, provider, time.Now().Add(-time.Second))
+	keys.VerificationKeys = []VerificationKey{
+		{Kid: "expired", Expiry: time.Now().Add(-time.Minute)},
+		{Kid: "valid", Expiry: time.Now().Add(time.Minute)},
+	}
+
+	err := rotater.Rotate(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kids []string
+	for _, k := range keys.VerificationKeys {
+		kids = append(kids, k.Kid)
+	}
+	if len(kids) != 2 || kids[0] != "valid" || kids[1] != "signing" {
+		t.Fatalf("verification keys = %v, want [valid signing]", kids)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	newKeys := func() Keys {
+		return Keys{
+			SigningKid: "signing",
+			NextKey:    localSigner{algorithm: "HS256", key: []byte("next")},
+			NextKid:    "next",
+			VerificationKeys: []VerificationKey{
+				{Kid: "first", Expiry: expiry},
+				{Kid: "second", Expiry: expiry},
+				{Kid: "third", Expiry: expiry},
+			},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		kids         []string
+		changed      bool
+		verification []string
+		next         string
+	}{
+		{name: "none", changed: false, verification: []string{"first", "second", "third"}, next: "next"},
+		{name: "unknown", kids: []string{"unknown"}, changed: false, verification: []string{"first", "second", "third"}, next: "next"},
+		{name: "verification key", kids: []string{"second"}, changed: true, verification: []string{"first", "third"}, next: "next"},
+		{name: "all verification keys", kids: []string{"first", "second", "third"}, changed: true, next: "next"},
+		{name: "next key", kids: []string{"next"}, changed: true, verification: []string{"first", "second", "third"}},
+		// The signing key has to be rotated before it can be dropped
+		{name: "signing key", kids: []string{"signing"}, changed: false, verification: []string{"first", "second", "third"}, next: "next"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := newKeys()
+			kids := map[string]bool{}
+			for _, kid := range tt.kids {
+				kids[kid] = true
+			}
+
+			changed := Revoke(&keys, kids)
+			if changed != tt.changed {
+				t.Errorf("got changed %t, want %t", changed, tt.changed)
+			}
+
+			var verification []string
+			for _, k := range keys.VerificationKeys {
+				verification = append(verification, k.Kid)
+			}
+			if strings.Join(verification, ",") != strings.Join(tt.verification, ",") {
+				t.Errorf("got verification keys %v, want %v", verification, tt.verification)
+			}
+			if keys.NextKid != tt.next || (keys.NextKey == nil) != (tt.next == "") {
+				t.Errorf("got next key %q, want %q", keys.NextKid, tt.next)
+			}
+			if keys.SigningKid != "signing" {
+				t.Error("signing key changed")
+			}
+		})
+	}
+}
+
+// A revoked signing key is demoted by a forced rotation and dropped afterwards
+func TestRevokeSigningKeyAfterRotation(t *testing.T) {
+	rotater, provider := testRotater(t)
+	keys := testKeys(t, provider, time.Now().Add(time.Hour))
+
+	err := rotater.ForceRotate(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Revoke(&keys, map[string]bool{"signing": true}) {
+		t.Fatal("rotated signing key not revoked")
+	}
+	for _, k := range keys.VerificationKeys {
+		if k.Kid == "signing" {
+			t.Error("revoked key still verifies")
+		}
+	}
+	if keys.SigningKey == nil || keys.SigningKid == "signing" {
+		t.Error("no new signing key after the rotation")
+	}
+}
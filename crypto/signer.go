@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"errors"
+	"strings"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	v1 "k8s.io/api/core/v1"
+)
+
+// SecretNextKeyPrefix prefixes the keys of the pre-published successor of the
+// signing key in the secret
+const SecretNextKeyPrefix = "next_"
+
+// Signer signs tokens with a private key. The private key may never leave
+// the backend holding it, so signing is done by the signer itself.
+type Signer interface {
+	// JWS algorithm of the signatures
+	Algorithm() string
+
+	// Sign returns the encoded signature of the signing string, the
+	// header and payload of a token.
+	Sign(signingString string) (string, error)
+
+	// Public returns the key verifying the signatures. For symmetric
+	// signers this is the shared secret, which must not be published.
+	Public() gocrypto.PublicKey
+
+	// PublicJWK exports the public key as JWK.
+	PublicJWK(kid, use string) (JWK, error)
+}
+
+// KeyProvider generates signing keys and stores them in secrets. New
+// algorithms and key backends are added by implementing a KeyProvider.
+type KeyProvider interface {
+	// Generate creates a new signing key.
+	Generate() (Signer, error)
+
+	// FromSecret loads the signing key stored in the secret.
+	FromSecret(secret *v1.Secret) (Signer, error)
+
+	// ToSecret stores the signing key and its key ID in the secret.
+	ToSecret(signer Signer, kid string, secret *v1.Secret) error
+}
+
+// KeyDestroyer is implemented by providers holding the private keys outside
+// of the secret, which have to be removed once they were rotated.
+type KeyDestroyer interface {
+	// Destroy removes the private key of the signer from the backend.
+	Destroy(signer Signer) error
+}
+
+// VersionDestroyer is implemented by destroyers holding the keys as versions
+// of a single backend key. Destroying a version destroys all older versions as
+// well, so a successor is only destroyed by rotating to a newer version.
+type VersionDestroyer interface {
+	KeyDestroyer
+
+	// DestroyAll removes the backend key with all its versions.
+	DestroyAll() error
+}
+
+// errKeyNotFound is wrapped by providers failing to load a key which is
+// missing in their backend
+var errKeyNotFound = errors.New("key not found")
+
+// IsKeyNotFound reports whether loading a key failed as it is missing in its
+// backend, e.g. as it was destroyed already.
+func IsKeyNotFound(err error) bool {
+	return errors.Is(err, errKeyNotFound)
+}
+
+// SignToken returns the signed and encoded token.
+func SignToken(signer Signer, token *jwtgo.Token) (string, error) {
+	signingString, err := token.SigningString()
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := signer.Sign(signingString)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{signingString, signature}, "."), nil
+}
+
+// KidFromSecret returns the key ID stored next to the private key. It is empty
+// for secrets written before the key ID was stored.
+func KidFromSecret(secret *v1.Secret) string {
+	return string(secret.Data[SecretKeyKid])
+}
+
+// NextToSecret stores the pre-published successor of the signing key in the
+// secret of the signing key, prefixing the keys written by the provider.
+func NextToSecret(provider KeyProvider, signer Signer, kid string, secret *v1.Secret) error {
+	next := &v1.Secret{}
+	err := provider.ToSecret(signer, kid, next)
+	if err != nil {
+		return err
+	}
+
+	if secret.StringData == nil {
+		secret.StringData = map[string]string{}
+	}
+	for k, v := range next.StringData {
+		secret.StringData[SecretNextKeyPrefix+k] = v
+	}
+	return nil
+}
+
+// NextFromSecret loads the pre-published successor of the signing key and its
+// key ID. The signer is nil if no successor is stored.
+func NextFromSecret(provider KeyProvider, secret *v1.Secret) (Signer, string, error) {
+	next := &v1.Secret{ObjectMeta: secret.ObjectMeta, Data: map[string][]byte{}}
+	for k, v := range secret.Data {
+		if strings.HasPrefix(k, SecretNextKeyPrefix) {
+			next.Data[strings.TrimPrefix(k, SecretNextKeyPrefix)] = v
+		}
+	}
+	if len(next.Data) == 0 {
+		return nil, "", nil
+	}
+
+	signer, err := provider.FromSecret(next)
+	if err != nil {
+		return nil, "", err
+	}
+	return signer, KidFromSecret(next), nil
+}
+
+// RemoveNextFromSecret removes the successor of a promoted signing key.
+func RemoveNextFromSecret(secret *v1.Secret) {
+	for k := range secret.Data {
+		if strings.HasPrefix(k, SecretNextKeyPrefix) {
+			delete(secret.Data, k)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package crypto
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Secret keys of the vault transit key name and version. The private key
+// never leaves vault.
+const SecretKeyVaultKey = "vault_key"
+const SecretKeyVaultVersion = "vault_version"
+
+// SecretKeyVaultLatestVersion holds the latest version of the transit key
+// ever stored in the secret, including revoked successors
+const SecretKeyVaultLatestVersion = "vault_latest_version"
+
+// DefaultVaultTransitMount is the path the transit engine is mounted at if no
+// mount is set
+const DefaultVaultTransitMount = "transit"
+
+// VaultConfig selects the vault server and transit engine holding the keys of
+// the vaultTransit backend.
+type VaultConfig struct {
+	// Address of the vault server, e.g. https://vault:8200
+	Address string
+
+	// Token authorizing the transit requests
+	Token string
+
+	// Path the transit engine is mounted at
+	Mount string
+}
+
+// vaultProvider delegates key generation, rotation and signing to a key of
+// a vault transit engine. Every rotation adds a new version to the key.
+type vaultProvider struct {
+	client    vaultClient
+	key       string
+	algorithm string
+	keySize   int
+
+	// Latest version stored in the secret, versions above were generated
+	// but never stored
+	stored int
+}
+
+// vaultSigner signs with a version of a vault transit key.
+type vaultSigner struct {
+	provider vaultProvider
+	version  int
+	public   gocrypto.PublicKey
+}
+
+type vaultClient struct {
+	config VaultConfig
+	http   *http.Client
+}
+
+// vaultKey is the part of a transit key read by the provider
+type vaultKey struct {
+	LatestVersion        int `json:"latest_version"`
+	MinEncryptionVersion int `json:"min_encryption_version"`
+	Keys                 map[string]struct {
+		PublicKey string `json:"public_key"`
+	} `json:"keys"`
+}
+
+// errVaultNotFound is returned for requests to missing keys
+var errVaultNotFound = fmt.Errorf("not found")
+
+// NewVaultTransitProvider returns a provider for keys of the JWS algorithm,
+// which are held by the transit key with the name. HMAC algorithms are not
+// supported, as transit keys of that type can not export a verification key.
+// The secret holds the versions in use, it is nil before the keys are stored.
+func NewVaultTransitProvider(config VaultConfig, key, algorithm string, keySize int, secret *v1.Secret) (KeyProvider, error) {
+	_, err := vaultKeyType(algorithm, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Mount == "" {
+		config.Mount = DefaultVaultTransitMount
+	}
+
+	return vaultProvider{
+		client:    vaultClient{config: config, http: &http.Client{Timeout: 30 * time.Second}},
+		key:       key,
+		algorithm: algorithm,
+		keySize:   keySize,
+		stored:    vaultStoredVersion(secret),
+	}, nil
+}
+
+// vaultStoredVersion returns the latest version stored in the secret by the
+// signing key, its successor or a revoked successor.
+func vaultStoredVersion(secret *v1.Secret) int {
+	if secret == nil {
+		return 0
+	}
+
+	stored := 0
+	for _, k := range []string{SecretKeyVaultVersion, SecretKeyVaultLatestVersion} {
+		for _, prefix := range []string{"", SecretNextKeyPrefix} {
+			version, err := strconv.Atoi(string(secret.Data[prefix+k]))
+			if err == nil && version > stored {
+				stored = version
+			}
+		}
+	}
+	return stored
+}
+
+// vaultKeyType returns the transit key type of the JWS algorithm.
+func vaultKeyType(algorithm string, keySize int) (string, error) {
+	if keySize == 0 {
+		keySize = DefaultRSAKeySize
+	}
+
+	switch algorithm {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		return fmt.Sprintf("rsa-%d", keySize), nil
+	case "ES256":
+		return "ecdsa-p256", nil
+	case "ES384":
+		return "ecdsa-p384", nil
+	case "ES512":
+		return "ecdsa-p521", nil
+	case "EdDSA":
+		return "ed25519", nil
+	}
+
+	return "", fmt.Errorf("unsupported vault transit algorithm %s", algorithm)
+}
+
+// Generate creates the transit key, or rotates it if it already exists. The
+// new signer uses the latest version of the key. A latest version which was
+// never stored in the secret is used instead of rotating again, so retries
+// after a failed secret update do not add a version each.
+func (p vaultProvider) Generate() (Signer, error) {
+	key, err := p.readKey()
+	switch {
+	case err == nil && p.stored > 0 && key.LatestVersion > p.stored:
+		return p.signer(key, key.LatestVersion)
+	case err == errVaultNotFound:
+		keyType, err := vaultKeyType(p.algorithm, p.keySize)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.client.request(http.MethodPost, "keys/"+p.key, map[string]interface{}{"type": keyType}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create vault transit key %s: %v", p.key, err)
+		}
+	case err != nil:
+		return nil, err
+	default:
+		err = p.client.request(http.MethodPost, "keys/"+p.key+"/rotate", nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rotate vault transit key %s: %v", p.key, err)
+		}
+	}
+
+	key, err = p.readKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.signer(key, key.LatestVersion)
+}
+
+func (p vaultProvider) FromSecret(secret *v1.Secret) (Signer, error) {
+	if name := string(secret.Data[SecretKeyVaultKey]); name != p.key {
+		return nil, fmt.Errorf("secret %s holds vault transit key %q instead of %q", secret.Name, name, p.key)
+	}
+
+	version, err := strconv.Atoi(string(secret.Data[SecretKeyVaultVersion]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault transit key version in secret %s: %v", secret.Name, err)
+	}
+
+	key, err := p.readKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.signer(key, version)
+}
+
+func (p vaultProvider) ToSecret(signer Signer, kid string, secret *v1.Secret) error {
+	s, ok := signer.(vaultSigner)
+	if !ok {
+		return fmt.Errorf("unsupported signer %T", signer)
+	}
+
+	latest := s.version
+	if p.stored > latest {
+		latest = p.stored
+	}
+
+	secret.StringData = map[string]string{
+		SecretKeyVaultKey:           p.key,
+		SecretKeyVaultVersion:       strconv.Itoa(s.version),
+		SecretKeyVaultLatestVersion: strconv.Itoa(latest),
+		SecretKeyKid:                kid,
+	}
+	return nil
+}
+
+// Destroy trims the version of a rotated signing key or revoked successor and
+// all older ones, so they can not sign anymore. Their public keys stay
+// available in the status for verification. The latest version is kept, it
+// was generated but not stored and is used by the next Generate. A revoked
+// successor is only trimmed once a newer version was generated, the signing
+// key is rotated past it.
+func (p vaultProvider) Destroy(signer Signer) error {
+	s, ok := signer.(vaultSigner)
+	if !ok {
+		return fmt.Errorf("unsupported signer %T", signer)
+	}
+
+	key, err := p.readKey()
+	if err != nil {
+		return err
+	}
+
+	min := s.version + 1
+	if min > key.LatestVersion || min <= key.MinEncryptionVersion {
+		return nil
+	}
+
+	err = p.client.request(http.MethodPost, "keys/"+p.key+"/config", map[string]interface{}{
+		"min_decryption_version": min,
+		"min_encryption_version": min,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to configure vault transit key %s: %v", p.key, err)
+	}
+
+	err = p.client.request(http.MethodPost, "keys/"+p.key+"/trim", map[string]interface{}{
+		"min_available_version": min,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to trim vault transit key %s: %v", p.key, err)
+	}
+	return nil
+}
+
+// DestroyAll deletes the transit key with all its versions. A missing key was
+// deleted already.
+func (p vaultProvider) DestroyAll() error {
+	_, err := p.readKey()
+	if err == errVaultNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = p.client.request(http.MethodPost, "keys/"+p.key+"/config", map[string]interface{}{
+		"deletion_allowed": true,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to configure vault transit key %s: %v", p.key, err)
+	}
+
+	err = p.client.request(http.MethodDelete, "keys/"+p.key, nil, nil)
+	if err != nil && err != errVaultNotFound {
+		return fmt.Errorf("failed to delete vault transit key %s: %v", p.key, err)
+	}
+	return nil
+}
+
+func (p vaultProvider) readKey() (vaultKey, error) {
+	key := vaultKey{}
+	err := p.client.request(http.MethodGet, "keys/"+p.key, nil, &key)
+	if err == errVaultNotFound {
+		return key, err
+	}
+	if err != nil {
+		return key, fmt.Errorf("failed to read vault transit key %s: %v", p.key, err)
+	}
+	return key, nil
+}
+
+// signer returns the signer of a key version with its public key.
+func (p vaultProvider) signer(key vaultKey, version int) (Signer, error) {
+	k, ok := key.Keys[strconv.Itoa(version)]
+	if !ok || k.PublicKey == "" {
+		return nil, fmt.Errorf("version %d of vault transit key %s not found", version, p.key)
+	}
+
+	// Ed25519 keys are returned base64 encoded, all others PEM encoded
+	var pub gocrypto.PublicKey
+	var err error
+	if p.algorithm == "EdDSA" {
+		var raw []byte
+		raw, err = base64.StdEncoding.DecodeString(k.PublicKey)
+		pub = ed25519.PublicKey(raw)
+	} else {
+		pub, err = EncodePublic(k.PublicKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of vault transit key %s: %v", p.key, err)
+	}
+
+	return vaultSigner{provider: p, version: version, public: pub}, nil
+}
+
+func (s vaultSigner) Algorithm() string {
+	return s.provider.algorithm
+}
+
+func (s vaultSigner) Sign(signingString string) (string, error) {
+	p := s.provider
+
+	body := map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString([]byte(signingString)),
+		"key_version":          s.version,
+		"marshaling_algorithm": "jws",
+	}
+
+	path := "sign/" + p.key
+	switch p.algorithm {
+	case "RS256", "RS384", "RS512":
+		body["signature_algorithm"] = "pkcs1v15"
+	case "PS256", "PS384", "PS512":
+		// The salt is as long as the hash (RFC 7518, section 3.5)
+		body["signature_algorithm"] = "pss"
+		body["salt_length"] = "hash"
+	}
+	switch p.algorithm[len(p.algorithm)-3:] {
+	case "256":
+		path += "/sha2-256"
+	case "384":
+		path += "/sha2-384"
+	case "512":
+		path += "/sha2-512"
+	}
+
+	result := struct {
+		Signature string `json:"signature"`
+	}{}
+	err := p.client.request(http.MethodPost, path, body, &result)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign with vault transit key %s: %v", p.key, err)
+	}
+
+	// Signatures are prefixed with the key version, vault:v1:signature
+	parts := strings.SplitN(result.Signature, ":", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid signature of vault transit key %s", p.key)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		signature, err = base64.StdEncoding.DecodeString(parts[2])
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid signature of vault transit key %s: %v", p.key, err)
+	}
+
+	return jwtgo.EncodeSegment(signature), nil
+}
+
+func (s vaultSigner) Public() gocrypto.PublicKey {
+	return s.public
+}
+
+func (s vaultSigner) PublicJWK(kid, use string) (JWK, error) {
+	return PublicJWK(s.public, kid, s.provider.algorithm, use)
+}
+
+// request sends a request to the transit engine and decodes the data of the
+// response into out.
+func (c vaultClient) request(method, path string, body interface{}, out interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	url := strings.TrimSuffix(c.config.Address, "/") + "/v1/" + c.config.Mount + "/" + path
+	req, err := http.NewRequest(method, url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errVaultNotFound
+	}
+
+	response := struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}{}
+	if resp.StatusCode != http.StatusNoContent {
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		if err != nil {
+			return fmt.Errorf("failed to decode vault response: %v", err)
+		}
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(response.Errors, ", "))
+	}
+
+	if out == nil || len(response.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response.Data, out)
+}
@@ -0,0 +1,525 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	v1 "k8s.io/api/core/v1"
+)
+
+const testVaultToken = "test-token"
+
+// fakeTransit serves the transit endpoints used by the provider for a single
+// key type.
+type fakeTransit struct {
+	algorithm string
+
+	keys            map[string][]gocrypto.PrivateKey
+	minEncryption   map[string]int
+	deletionAllowed map[string]bool
+
+	// Requests by method and path, e.g. "POST keys/test/rotate"
+	requests []string
+	// Bodies of the sign requests
+	signRequests []map[string]interface{}
+}
+
+func newFakeTransit(algorithm string) *fakeTransit {
+	return &fakeTransit{
+		algorithm:       algorithm,
+		keys:            map[string][]gocrypto.PrivateKey{},
+		minEncryption:   map[string]int{},
+		deletionAllowed: map[string]bool{},
+	}
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors":["permission denied"]}`)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/transit/")
+	f.requests = append(f.requests, r.Method+" "+path)
+	parts := strings.Split(path, "/")
+
+	body := map[string]interface{}{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	switch {
+	case parts[0] == "keys" && len(parts) == 2 && r.Method == http.MethodGet:
+		f.readKey(w, parts[1])
+	case parts[0] == "keys" && len(parts) == 2 && r.Method == http.MethodDelete:
+		if !f.deletionAllowed[parts[1]] {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":["deletion is not allowed for this key"]}`)
+			return
+		}
+		delete(f.keys, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "keys" && len(parts) == 2:
+		f.addVersion(parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "keys" && parts[2] == "rotate":
+		f.addVersion(parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "keys" && parts[2] == "config":
+		if min, ok := body["min_encryption_version"].(float64); ok {
+			f.minEncryption[parts[1]] = int(min)
+		}
+		if allowed, ok := body["deletion_allowed"].(bool); ok {
+			f.deletionAllowed[parts[1]] = allowed
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "keys" && parts[2] == "trim":
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "sign":
+		f.signRequests = append(f.signRequests, body)
+		f.sign(w, parts[1], parts[len(parts)-1], body)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeTransit) addVersion(name string) {
+	key, err := GenerateKey(f.algorithm, 2048)
+	if err != nil {
+		panic(err)
+	}
+	f.keys[name] = append(f.keys[name], key)
+}
+
+func (f *fakeTransit) readKey(w http.ResponseWriter, name string) {
+	versions, ok := f.keys[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[]}`)
+		return
+	}
+
+	keys := map[string]interface{}{}
+	for i, key := range versions {
+		var public string
+		if k, ok := key.(ed25519.PrivateKey); ok {
+			public = base64.StdEncoding.EncodeToString(k.Public().(ed25519.PublicKey))
+		} else {
+			der, _ := x509.MarshalPKIXPublicKey(key.(gocrypto.Signer).Public())
+			public = string(pem.EncodeToMemory(&pem.Block{Type: BlockTypePKIXPublic, Bytes: der}))
+		}
+		keys[strconv.Itoa(i+1)] = map[string]interface{}{"public_key": public}
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+		"latest_version":         len(versions),
+		"min_encryption_version": f.minEncryption[name],
+		"keys":                   keys,
+	}})
+}
+
+func (f *fakeTransit) sign(w http.ResponseWriter, name, hashName string, body map[string]interface{}) {
+	version := int(body["key_version"].(float64))
+	if version < f.minEncryption[name] || version > len(f.keys[name]) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"errors":["requested version for signing is less than the minimum encryption key version"]}`)
+		return
+	}
+	key := f.keys[name][version-1]
+
+	input, _ := base64.StdEncoding.DecodeString(body["input"].(string))
+	hash := map[string]gocrypto.Hash{"sha2-256": gocrypto.SHA256, "sha2-384": gocrypto.SHA384, "sha2-512": gocrypto.SHA512}[hashName]
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, input)
+	case *rsa.PrivateKey:
+		digest := hash.New()
+		digest.Write(input)
+		if body["signature_algorithm"] == "pss" {
+			signature, err = rsa.SignPSS(rand.Reader, k, hash, digest.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest.Sum(nil))
+		}
+	case *ecdsa.PrivateKey:
+		// Signatures are marshaled as r || s with the jws marshaling algorithm
+		digest := hash.New()
+		digest.Write(input)
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature, err = append(padded(r, size), padded(s, size)...), signErr
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+		"signature": fmt.Sprintf("vault:v%d:%s", version, base64.RawURLEncoding.EncodeToString(signature)),
+	}})
+}
+
+func (f *fakeTransit) count(request string) int {
+	n := 0
+	for _, r := range f.requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestVaultProvider(t *testing.T, server *httptest.Server, algorithm string, secret *v1.Secret) vaultProvider {
+	provider, err := NewVaultTransitProvider(VaultConfig{Address: server.URL, Token: testVaultToken}, "test", algorithm, 2048, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.(vaultProvider)
+}
+
+// storedSecret returns the secret as read back from the API server.
+func storedSecret(t *testing.T, provider KeyProvider, signer Signer) *v1.Secret {
+	secret := &v1.Secret{}
+	err := provider.ToSecret(signer, "kid", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret.Data = map[string][]byte{}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+	return secret
+}
+
+func TestVaultSignVerify(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "RS512", "PS256", "PS384", "ES256", "ES384", "ES512", "EdDSA"} {
+		t.Run(algorithm, func(t *testing.T) {
+			transit := newFakeTransit(algorithm)
+			server := httptest.NewServer(transit)
+			defer server.Close()
+			provider := newTestVaultProvider(t, server, transit.algorithm, nil)
+
+			signer, err := provider.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := newTestVaultProvider(t, server, transit.algorithm, nil).FromSecret(storedSecret(t, provider, signer))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := jwtgo.NewWithClaims(jwtgo.GetSigningMethod(algorithm), jwtgo.MapClaims{"sub": "test"})
+			signed, err := SignToken(loaded, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = jwtgo.Parse(signed, func(*jwtgo.Token) (interface{}, error) {
+				return signer.Public(), nil
+			})
+			if err != nil {
+				t.Fatalf("token does not verify: %v", err)
+			}
+
+			request := transit.signRequests[0]
+			if request["marshaling_algorithm"] != "jws" {
+				t.Errorf("marshaling_algorithm = %v, want jws", request["marshaling_algorithm"])
+			}
+			if request["key_version"] != float64(1) {
+				t.Errorf("key_version = %v, want 1", request["key_version"])
+			}
+			if strings.HasPrefix(algorithm, "PS") && request["salt_length"] != "hash" {
+				t.Errorf("salt_length = %v, want hash", request["salt_length"])
+			}
+		})
+	}
+}
+
+func TestVaultGenerateRotatesStoredVersion(t *testing.T) {
+	transit := newFakeTransit("ES256")
+	server := httptest.NewServer(transit)
+	defer server.Close()
+	provider := newTestVaultProvider(t, server, transit.algorithm, nil)
+
+	first, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transit.count("POST keys/test") != 1 {
+		t.Fatalf("key not created: %v", transit.requests)
+	}
+	secret := storedSecret(t, provider, first)
+
+	// The stored version is rotated
+	provider = newTestVaultProvider(t, server, transit.algorithm, secret)
+	second, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := second.(vaultSigner).version; v != 2 {
+		t.Fatalf("version = %d, want 2", v)
+	}
+
+	// The second version was never stored, so it is reused by retries
+	retry, err := newTestVaultProvider(t, server, transit.algorithm, secret).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := retry.(vaultSigner).version; v != 2 {
+		t.Fatalf("retry version = %d, want 2", v)
+	}
+	if n := transit.count("POST keys/test/rotate"); n != 1 {
+		t.Fatalf("rotated %d times, want 1", n)
+	}
+}
+
+func TestVaultRevokedSuccessorIsNotReused(t *testing.T) {
+	transit := newFakeTransit("ES256")
+	server := httptest.NewServer(transit)
+	defer server.Close()
+	provider := newTestVaultProvider(t, server, transit.algorithm, nil)
+
+	signer, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := storedSecret(t, provider, signer)
+
+	provider = newTestVaultProvider(t, server, transit.algorithm, secret)
+	next, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NextToSecret(provider, next, "next", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+
+	// The successor is revoked and removed from the secret
+	provider = newTestVaultProvider(t, server, transit.algorithm, secret)
+	RemoveNextFromSecret(secret)
+	secret = storedSecret(t, provider, signer)
+
+	generated, err := newTestVaultProvider(t, server, transit.algorithm, secret).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := generated.(vaultSigner).version; v != 3 {
+		t.Fatalf("version = %d, want 3", v)
+	}
+}
+
+func TestVaultDestroyTrimsRotatedVersions(t *testing.T) {
+	transit := newFakeTransit("ES256")
+	server := httptest.NewServer(transit)
+	defer server.Close()
+	provider := newTestVaultProvider(t, server, transit.algorithm, nil)
+
+	rotated, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider = newTestVaultProvider(t, server, transit.algorithm, storedSecret(t, provider, rotated))
+	signer, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The latest version is never trimmed
+	err = provider.Destroy(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := transit.count("POST keys/test/config"); n != 0 {
+		t.Fatalf("latest version trimmed")
+	}
+
+	err = provider.Destroy(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transit.count("POST keys/test/config") != 1 || transit.count("POST keys/test/trim") != 1 {
+		t.Fatalf("rotated version not trimmed: %v", transit.requests)
+	}
+	if transit.minEncryption["test"] != 2 {
+		t.Fatalf("min_encryption_version = %d, want 2", transit.minEncryption["test"])
+	}
+
+	_, err = rotated.Sign("test")
+	if err == nil {
+		t.Fatal("destroyed version still signs")
+	}
+	_, err = signer.Sign("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Destroying again does not configure the key again
+	err = provider.Destroy(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := transit.count("POST keys/test/config"); n != 1 {
+		t.Fatalf("configured %d times, want 1", n)
+	}
+}
+
+func TestVaultDestroyRevokedSuccessor(t *testing.T) {
+	transit := newFakeTransit("ES256")
+	server := httptest.NewServer(transit)
+	defer server.Close()
+	provider := newTestVaultProvider(t, server, transit.algorithm, nil)
+
+	signer, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := storedSecret(t, provider, signer)
+	provider = newTestVaultProvider(t, server, transit.algorithm, secret)
+	next, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NextToSecret(provider, next, "next", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range secret.StringData {
+		secret.Data[k] = []byte(v)
+	}
+
+	// The revoked successor is rotated past, which destroys it together
+	// with the signing key
+	provider = newTestVaultProvider(t, server, transit.algorithm, secret)
+	rotated, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, destroyed := range []Signer{next, signer} {
+		err = provider.Destroy(destroyed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if transit.minEncryption["test"] != 3 {
+		t.Fatalf("min_encryption_version = %d, want 3", transit.minEncryption["test"])
+	}
+	for _, destroyed := range []Signer{next, signer} {
+		_, err = destroyed.Sign("test")
+		if err == nil {
+			t.Fatalf("destroyed version %d still signs", destroyed.(vaultSigner).version)
+		}
+	}
+	_, err = rotated.Sign("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultDestroyAll(t *testing.T) {
+	transit := newFakeTransit("ES256")
+	server := httptest.NewServer(transit)
+	defer server.Close()
+	provider := newTestVaultProvider(t, server, transit.algorithm, nil)
+
+	signer, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = provider.DestroyAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := transit.keys["test"]; ok {
+		t.Fatal("transit key not deleted")
+	}
+	if !transit.deletionAllowed["test"] {
+		t.Fatal("transit key deleted without allowing deletion")
+	}
+	_, err = signer.Sign("test")
+	if err == nil {
+		t.Fatal("deleted key still signs")
+	}
+
+	// A deleted key is not deleted again
+	err = provider.DestroyAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := transit.count("DELETE keys/test"); n != 1 {
+		t.Fatalf("deleted %d times, want 1", n)
+	}
+}
+
+func TestVaultErrors(t *testing.T) {
+	transit := newFakeTransit("RS256")
+
+	server := httptest.NewServer(transit)
+	defer server.Close()
+
+	denied, err := NewVaultTransitProvider(VaultConfig{Address: server.URL, Token: "invalid"}, "test", "RS256", 2048, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = denied.Generate()
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("err = %v, want permission denied", err)
+	}
+
+	_, err = NewVaultTransitProvider(VaultConfig{Address: server.URL}, "test", "HS256", 0, nil)
+	if err == nil {
+		t.Fatal("HMAC keys are not supported by transit")
+	}
+
+	provider := newTestVaultProvider(t, server, transit.algorithm, nil)
+	signer, err := provider.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := storedSecret(t, provider, signer)
+
+	// Secrets of another key are rejected
+	other, err := NewVaultTransitProvider(VaultConfig{Address: server.URL, Token: testVaultToken}, "other", "RS256", 2048, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.FromSecret(secret)
+	if err == nil {
+		t.Fatal("secret of another key loaded")
+	}
+
+	// Missing versions are reported
+	secret.Data[SecretKeyVaultVersion] = []byte("5")
+	_, err = provider.FromSecret(secret)
+	if err == nil || !strings.Contains(err.Error(), "version 5") {
+		t.Fatalf("err = %v, want missing version", err)
+	}
+
+	secret.Data[SecretKeyVaultVersion] = []byte("latest")
+	_, err = provider.FromSecret(secret)
+	if err == nil {
+		t.Fatal("invalid version loaded")
+	}
+}
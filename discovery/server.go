@@ -0,0 +1,291 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	"github.com/hexhibit-xyz/toope/controllers"
+	"github.com/hexhibit-xyz/toope/crypto"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const wellKnownPath = "/.well-known/openid-configuration"
+const keysPath = "/keys"
+
+// maxCacheAge limits the caching of the documents, so verifiers pick up
+// revoked keys and status changes missed by the computed max-age quickly
+const maxCacheAge = 5 * time.Minute
+
+// RotatingKeyPrefix is the path prefix of the documents of a single rotating
+// key, followed by its namespace and name.
+const RotatingKeyPrefix = "/rotatingkeys"
+
+// Server serves the OpenID Connect discovery document and the key set of the
+// rotating keys. Keys sharing an issuer are served together at the path of
+// the issuer URL to requests for the host of the issuer URL, every key is
+// also served at /rotatingkeys/<namespace>/<name>. The discovery document is
+// only served for keys with an issuer.
+type Server struct {
+	// Address the server listens on
+	Addr string
+
+	// Reader of the rotating keys and their key sets, usually the informer cache
+	Reader client.Reader
+
+	Log logr.Logger
+}
+
+// providerMetadata is the subset of the OpenID Provider Metadata (OpenID
+// Connect Discovery 1.0, section 3) describing how tokens are verified.
+type providerMetadata struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Start serves until the stop channel is closed.
+func (s *Server) Start(stop <-chan struct{}) error {
+	srv := &http.Server{Addr: s.Addr, Handler: s}
+
+	errs := make(chan error, 1)
+	go func() {
+		s.Log.Info("serving discovery documents", "addr", s.Addr)
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	case err := <-errs:
+		return err
+	}
+}
+
+// NeedLeaderElection is false, every replica serves the documents.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Path
+	var base string
+	switch {
+	case strings.HasSuffix(path, wellKnownPath):
+		base = strings.TrimSuffix(path, wellKnownPath)
+	case strings.HasSuffix(path, keysPath):
+		base = strings.TrimSuffix(path, keysPath)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := context.Background()
+	keys, issuer, err := s.rotatingKeys(ctx, r.Host, base)
+	if err != nil {
+		s.Log.Error(err, "failed to get rotating keys", "path", path)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The documents are cached by everyone, so the URLs are taken from the
+	// configured issuer and never from the request
+	var document interface{}
+	if strings.HasSuffix(path, wellKnownPath) {
+		if issuer == "" {
+			http.NotFound(w, r)
+			return
+		}
+		document = metadata(keys, issuer, strings.TrimSuffix(issuer, "/")+keysPath)
+	} else {
+		document, err = s.keySet(ctx, keys)
+		if err != nil {
+			s.Log.Error(err, "failed to get key set", "path", path)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		s.Log.Error(err, "failed to encode document", "path", path)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", cacheControl(keys, time.Now()))
+	_, _ = w.Write(encoded)
+}
+
+// rotatingKeys returns the keys served at the host and base path together
+// with their issuer. Keys whose issuer URL has the host and base path win
+// over a single key.
+func (s *Server) rotatingKeys(ctx context.Context, host, base string) ([]tokensv1alpha1.RotatingKey, string, error) {
+	list := &tokensv1alpha1.RotatingKeyList{}
+	err := s.Reader.List(ctx, list)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var keys []tokensv1alpha1.RotatingKey
+	var issuer string
+	for _, k := range list.Items {
+		if k.Spec.Issuer == "" {
+			continue
+		}
+		u, err := url.Parse(k.Spec.Issuer)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Host, host) && strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(base, "/") {
+			keys = append(keys, k)
+			issuer = k.Spec.Issuer
+		}
+	}
+	if len(keys) > 0 {
+		return keys, issuer, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(base, RotatingKeyPrefix+"/"), "/")
+	if !strings.HasPrefix(base, RotatingKeyPrefix+"/") || len(parts) != 2 {
+		return nil, "", nil
+	}
+
+	key := tokensv1alpha1.RotatingKey{}
+	err = s.Reader.Get(ctx, types.NamespacedName{Namespace: parts[0], Name: parts[1]}, &key)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	return []tokensv1alpha1.RotatingKey{key}, key.Spec.Issuer, nil
+}
+
+// keySet merges the published key sets of the keys.
+func (s *Server) keySet(ctx context.Context, keys []tokensv1alpha1.RotatingKey) (crypto.JWKS, error) {
+	jwks := crypto.JWKS{Keys: []crypto.JWK{}}
+
+	for _, k := range keys {
+		configMap := &v1.ConfigMap{}
+		err := s.Reader.Get(ctx, types.NamespacedName{Name: k.Name, Namespace: k.Namespace}, configMap)
+		if err != nil {
+			// Keys which were not published yet are skipped
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return jwks, err
+		}
+
+		set := crypto.JWKS{}
+		err = json.Unmarshal([]byte(configMap.Data[controllers.JWKSConfigMapKey]), &set)
+		if err != nil {
+			return jwks, fmt.Errorf("invalid key set of %s/%s: %v", k.Namespace, k.Name, err)
+		}
+		jwks.Keys = append(jwks.Keys, set.Keys...)
+	}
+
+	return jwks, nil
+}
+
+func metadata(keys []tokensv1alpha1.RotatingKey, issuer, jwksURI string) providerMetadata {
+	algorithms := []string{}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		k.Default()
+
+		// Shared secrets can not be used by other parties to verify tokens
+		alg := k.Spec.Algorithm
+		if seen[alg] || strings.HasPrefix(alg, "HS") {
+			continue
+		}
+		seen[alg] = true
+		algorithms = append(algorithms, alg)
+	}
+
+	return providerMetadata{
+		Issuer:                           issuer,
+		JWKSURI:                          jwksURI,
+		ResponseTypesSupported:           []string{"id_token"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: algorithms,
+	}
+}
+
+// cacheControl allows the documents to be cached until the next change of
+// any of the keys, which is the publication of the next key, the rotation or
+// the expiry of a verification key, but at most for maxCacheAge.
+func cacheControl(keys []tokensv1alpha1.RotatingKey, now time.Time) string {
+	if len(keys) == 0 {
+		return "no-cache"
+	}
+
+	maxAge := maxCacheAge
+	for _, k := range keys {
+		var until time.Duration
+		if k.Status.NexRotation != nil {
+			until = k.Status.NexRotation.Sub(now)
+		}
+
+		// Before the next key is published, the documents must not be
+		// cached past its publication
+		if before, err := time.ParseDuration(k.Spec.PublishBefore); err == nil && until-before > 0 {
+			until -= before
+		}
+
+		for _, vk := range k.Status.VerificationKeys {
+			if expiry := vk.ExpireAt.Sub(now); expiry > 0 && expiry < until {
+				until = expiry
+			}
+		}
+
+		if until < maxAge {
+			maxAge = until
+		}
+	}
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+
+	return fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second))
+}
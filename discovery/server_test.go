@@ -0,0 +1,177 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	"github.com/hexhibit-xyz/toope/controllers"
+	"github.com/hexhibit-xyz/toope/crypto"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func testServer(t *testing.T, keys ...*tokensv1alpha1.RotatingKey) *Server {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokensv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	var objects []runtime.Object
+	for _, k := range keys {
+		objects = append(objects, k, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: k.Name, Namespace: k.Namespace},
+			Data:       map[string]string{controllers.JWKSConfigMapKey: `{"keys":[{"kty":"EC","kid":"` + k.Name + `"}]}`},
+		})
+	}
+
+	return &Server{Reader: fake.NewFakeClientWithScheme(scheme, objects...), Log: ctrl.Log}
+}
+
+func testKey(namespace, name, issuer string) *tokensv1alpha1.RotatingKey {
+	return &tokensv1alpha1.RotatingKey{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       tokensv1alpha1.RotatingKeySpec{Algorithm: "ES256", Issuer: issuer, RotateAfter: "24h"},
+		Status:     tokensv1alpha1.RotatingKeyStatus{NexRotation: &metav1.Time{Time: time.Now().Add(time.Hour)}},
+	}
+}
+
+func get(t *testing.T, s *Server, url string, out interface{}) int {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if w.Code == http.StatusOK && out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func kids(jwks crypto.JWKS) []string {
+	var kids []string
+	for _, k := range jwks.Keys {
+		kids = append(kids, k.Kid)
+	}
+	return kids
+}
+
+func TestServerMatchesIssuerHostAndPath(t *testing.T) {
+	s := testServer(t,
+		testKey("a", "first", "https://first.example.com/tenant"),
+		testKey("b", "second", "https://second.example.com/tenant/"),
+		testKey("c", "third", "https://first.example.com/tenant"),
+	)
+
+	jwks := crypto.JWKS{}
+	if code := get(t, s, "http://first.example.com/tenant/keys", &jwks); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if got := kids(jwks); len(got) != 2 || got[0] == "second" || got[1] == "second" {
+		t.Errorf("keys of first.example.com = %v, want first and third", got)
+	}
+
+	meta := providerMetadata{}
+	if code := get(t, s, "http://second.example.com/tenant/.well-known/openid-configuration", &meta); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if meta.Issuer != "https://second.example.com/tenant/" {
+		t.Errorf("issuer = %s", meta.Issuer)
+	}
+
+	if code := get(t, s, "http://other.example.com/tenant/keys", nil); code != http.StatusNotFound {
+		t.Errorf("unknown host served with status %d", code)
+	}
+}
+
+func TestServerMetadataFromIssuer(t *testing.T) {
+	s := testServer(t, testKey("a", "key", "https://issuer.example.com/tenant"), testKey("a", "internal", ""))
+
+	for _, url := range []string{
+		"http://issuer.example.com/tenant/.well-known/openid-configuration",
+		"http://attacker.example.com/rotatingkeys/a/key/.well-known/openid-configuration",
+	} {
+		meta := providerMetadata{}
+		if code := get(t, s, url, &meta); code != http.StatusOK {
+			t.Fatalf("%s: status %d", url, code)
+		}
+		if meta.Issuer != "https://issuer.example.com/tenant" {
+			t.Errorf("%s: issuer = %s", url, meta.Issuer)
+		}
+		if meta.JWKSURI != "https://issuer.example.com/tenant/keys" {
+			t.Errorf("%s: jwks_uri = %s", url, meta.JWKSURI)
+		}
+	}
+
+	// Keys without issuer only serve their key set
+	if code := get(t, s, "http://any/rotatingkeys/a/internal/.well-known/openid-configuration", nil); code != http.StatusNotFound {
+		t.Errorf("discovery document of key without issuer served with status %d", code)
+	}
+	jwks := crypto.JWKS{}
+	if code := get(t, s, "http://any/rotatingkeys/a/internal/keys", &jwks); code != http.StatusOK || len(jwks.Keys) != 1 {
+		t.Errorf("key set of key without issuer: status %d, keys %v", code, kids(jwks))
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	now := time.Now()
+	key := func(nextRotation time.Duration, publishBefore string, expiries ...time.Duration) tokensv1alpha1.RotatingKey {
+		k := tokensv1alpha1.RotatingKey{
+			Spec:   tokensv1alpha1.RotatingKeySpec{PublishBefore: publishBefore},
+			Status: tokensv1alpha1.RotatingKeyStatus{NexRotation: &metav1.Time{Time: now.Add(nextRotation)}},
+		}
+		for _, expiry := range expiries {
+			k.Status.VerificationKeys = append(k.Status.VerificationKeys, tokensv1alpha1.ValidationKey{ExpireAt: metav1.NewTime(now.Add(expiry))})
+		}
+		return k
+	}
+
+	tests := []struct {
+		name string
+		keys []tokensv1alpha1.RotatingKey
+		want string
+	}{
+		{"until rotation", []tokensv1alpha1.RotatingKey{key(4*time.Minute, "")}, "public, max-age=240"},
+		{"until publication", []tokensv1alpha1.RotatingKey{key(10*time.Minute, "8m")}, "public, max-age=120"},
+		{"published", []tokensv1alpha1.RotatingKey{key(2*time.Minute, "15m")}, "public, max-age=120"},
+		{"earliest key", []tokensv1alpha1.RotatingKey{key(4*time.Minute, ""), key(4*time.Minute, "3m")}, "public, max-age=60"},
+		{"until key expiry", []tokensv1alpha1.RotatingKey{key(time.Hour, "", 10*time.Minute, 90*time.Second)}, "public, max-age=90"},
+		{"expired key", []tokensv1alpha1.RotatingKey{key(4*time.Minute, "", -time.Minute)}, "public, max-age=240"},
+		{"capped", []tokensv1alpha1.RotatingKey{key(time.Hour, "15m", 2*time.Hour)}, "public, max-age=300"},
+		{"overdue", []tokensv1alpha1.RotatingKey{key(-time.Minute, "")}, "no-cache"},
+		{"no keys", nil, "no-cache"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheControl(tt.keys, now); got != tt.want {
+				t.Errorf("cacheControl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
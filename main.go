@@ -26,9 +26,13 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
 	"github.com/hexhibit-xyz/toope/controllers"
+	"github.com/hexhibit-xyz/toope/crypto"
+	"github.com/hexhibit-xyz/toope/discovery"
+	"github.com/hexhibit-xyz/toope/webhooks"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -47,10 +51,30 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var pkcs11Module, pkcs11TokenLabel string
+	var vaultAddress, vaultTransitMount string
+	var discoveryAddr string
+	var enableWebhooks bool
+	var injectPath string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&pkcs11Module, "pkcs11-module", "",
+		"Path of the PKCS#11 module holding the keys of the pkcs11 backend. "+
+			"The user PIN of the token is read from the PKCS11_PIN environment variable.")
+	flag.StringVar(&pkcs11TokenLabel, "pkcs11-token-label", "", "Label of the PKCS#11 token holding the keys.")
+	flag.StringVar(&vaultAddress, "vault-address", os.Getenv("VAULT_ADDR"),
+		"Address of the vault server of the vaultTransit backend. "+
+			"The vault token is read from the VAULT_TOKEN environment variable.")
+	flag.StringVar(&vaultTransitMount, "vault-transit-mount", crypto.DefaultVaultTransitMount,
+		"Path the vault transit engine is mounted at.")
+	flag.StringVar(&discoveryAddr, "discovery-addr", "",
+		"The address the OpenID Connect discovery documents and key sets are served on, disabled if empty.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve the admission webhooks. Requires the serving certificate of the webhook server.")
+	flag.StringVar(&injectPath, "inject-path", webhooks.DefaultInjectPath,
+		"Directory injected tokens are mounted at, unless set by the pod.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
@@ -67,24 +91,72 @@ func main() {
 		os.Exit(1)
 	}
 
+	var backends controllers.KeyBackends
+	if pkcs11Module != "" {
+		backends.PKCS11 = &crypto.PKCS11Config{
+			Module:     pkcs11Module,
+			TokenLabel: pkcs11TokenLabel,
+			Pin:        os.Getenv("PKCS11_PIN"),
+		}
+	}
+	if vaultAddress != "" {
+		backends.Vault = &crypto.VaultConfig{
+			Address: vaultAddress,
+			Token:   os.Getenv("VAULT_TOKEN"),
+			Mount:   vaultTransitMount,
+		}
+	}
+
 	if err = (&controllers.JwtReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Jwt"),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Jwt"),
+		Scheme:   mgr.GetScheme(),
+		Backends: backends,
+		Recorder: mgr.GetEventRecorderFor("jwt-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Jwt")
 		os.Exit(1)
 	}
 	if err = (&controllers.RotatingKeyReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("RotatingKey"),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("RotatingKey"),
+		Scheme:   mgr.GetScheme(),
+		Backends: backends,
+		Recorder: mgr.GetEventRecorderFor("rotatingkey-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "RotatingKey")
 		os.Exit(1)
 	}
 	// +kubebuilder:scaffold:builder
 
+	if enableWebhooks {
+		if err = (&tokensv1alpha1.Jwt{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Jwt")
+			os.Exit(1)
+		}
+		if err = (&tokensv1alpha1.RotatingKey{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "RotatingKey")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register(webhooks.PodInjectorPath, &webhook.Admission{Handler: &webhooks.PodInjector{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("PodInjector"),
+			Path:   injectPath,
+		}})
+	}
+
+	if discoveryAddr != "" {
+		err = mgr.Add(&discovery.Server{
+			Addr:   discoveryAddr,
+			Reader: mgr.GetCache(),
+			Log:    ctrl.Log.WithName("discovery"),
+		})
+		if err != nil {
+			setupLog.Error(err, "unable to add discovery server")
+			os.Exit(1)
+		}
+	}
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
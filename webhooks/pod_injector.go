@@ -0,0 +1,170 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/go-logr/logr"
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	"github.com/hexhibit-xyz/toope/controllers"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// PodInjectorPath is the path the pod injector is served at
+const PodInjectorPath = "/mutate-v1-pod"
+
+// DefaultInjectPath is the directory tokens are mounted at if the pod does not
+// set one
+const DefaultInjectPath = "/var/run/secrets/tokens.hexhibit.xyz"
+
+// Name of the volume holding the injected token
+const injectVolumeName = "toope-token"
+
+// Failures are ignored, as the webhook sees every pod of the namespaces
+// enabling injection. The namespace selector is set by a patch in
+// config/webhook, as markers do not support selectors.
+// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=inject.tokens.hexhibit.xyz
+
+// PodInjector mounts the token of the Jwt named by the inject annotation into
+// all containers of a pod.
+type PodInjector struct {
+	Client client.Client
+	Log    logr.Logger
+
+	// Directory tokens are mounted at, defaults to DefaultInjectPath
+	Path string
+
+	decoder *admission.Decoder
+}
+
+// InjectDecoder is called by the webhook server.
+func (i *PodInjector) InjectDecoder(d *admission.Decoder) error {
+	i.decoder = d
+	return nil
+}
+
+func (i *PodInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &v1.Pod{}
+	err := i.decoder.Decode(req, pod)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	name := pod.Annotations[tokensv1alpha1.InjectAnnotation]
+	if name == "" {
+		return admission.Allowed("no token requested")
+	}
+
+	// Pods created by controllers have no namespace set yet
+	namespace := pod.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+
+	token := &tokensv1alpha1.Jwt{}
+	err = i.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, token)
+	if errors.IsNotFound(err) {
+		return admission.Denied(fmt.Sprintf("jwt %s/%s requested by annotation %s not found", namespace, name, tokensv1alpha1.InjectAnnotation))
+	} else if err != nil {
+		i.Log.Error(err, "failed to get jwt", "jwt", name, "namespace", namespace)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	dir := pod.Annotations[tokensv1alpha1.InjectPathAnnotation]
+	if dir == "" {
+		dir = i.Path
+	}
+	if dir == "" {
+		dir = DefaultInjectPath
+	}
+	if !path.IsAbs(dir) {
+		return admission.Denied(fmt.Sprintf("annotation %s must be an absolute path", tokensv1alpha1.InjectPathAnnotation))
+	}
+
+	err = injectToken(pod, name, dir, pod.Annotations[tokensv1alpha1.InjectEnvAnnotation])
+	if err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// injectToken adds the secret of the Jwt as projected volume and mounts it
+// at the directory. A pod which already has the volume is left unchanged, a
+// container which already mounts another volume at the directory is rejected.
+func injectToken(pod *v1.Pod, jwt, dir, env string) error {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == injectVolumeName {
+			return nil
+		}
+	}
+
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, m := range c.VolumeMounts {
+				if path.Clean(m.MountPath) == path.Clean(dir) {
+					return fmt.Errorf("container %s already mounts volume %s at %s", c.Name, m.Name, dir)
+				}
+			}
+		}
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: injectVolumeName,
+		VolumeSource: v1.VolumeSource{
+			Projected: &v1.ProjectedVolumeSource{
+				Sources: []v1.VolumeProjection{{
+					Secret: &v1.SecretProjection{
+						// The secret of a Jwt has the name of the Jwt
+						LocalObjectReference: v1.LocalObjectReference{Name: jwt},
+						Items: []v1.KeyToPath{{
+							Key:  controllers.TokenSecretKey,
+							Path: controllers.TokenSecretKey,
+						}},
+					},
+				}},
+			},
+		},
+	})
+
+	mount := v1.VolumeMount{Name: injectVolumeName, MountPath: dir, ReadOnly: true}
+	file := path.Join(dir, controllers.TokenSecretKey)
+	inject := func(containers []v1.Container) {
+		for i := range containers {
+			containers[i].VolumeMounts = append(containers[i].VolumeMounts, mount)
+			if env != "" {
+				containers[i].Env = append(containers[i].Env, v1.EnvVar{Name: env, Value: file})
+			}
+		}
+	}
+	inject(pod.Spec.InitContainers)
+	inject(pod.Spec.Containers)
+	return nil
+}
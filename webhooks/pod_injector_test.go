@@ -0,0 +1,160 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	tokensv1alpha1 "github.com/hexhibit-xyz/toope/api/v1alpha1"
+	"github.com/hexhibit-xyz/toope/controllers"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newTestPodInjector(t *testing.T) *PodInjector {
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, tokensv1alpha1.AddToScheme} {
+		err := add(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token := &tokensv1alpha1.Jwt{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"}}
+	injector := &PodInjector{
+		Client: fake.NewFakeClientWithScheme(scheme, token),
+		Log:    ctrl.Log.WithName("test"),
+	}
+
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = injector.InjectDecoder(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return injector
+}
+
+func testPod(annotations map[string]string, mounts ...v1.VolumeMount) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", Annotations: annotations},
+		Spec: v1.PodSpec{
+			InitContainers: []v1.Container{{Name: "init", Image: "init"}},
+			Containers:     []v1.Container{{Name: "app", Image: "app", VolumeMounts: mounts}},
+		},
+	}
+}
+
+func TestPodInjectorHandle(t *testing.T) {
+	inject := map[string]string{tokensv1alpha1.InjectAnnotation: "token"}
+
+	tests := []struct {
+		name    string
+		pod     *v1.Pod
+		allowed bool
+		patched bool
+	}{
+		{name: "no annotation", pod: testPod(nil), allowed: true},
+		{name: "inject", pod: testPod(inject), allowed: true, patched: true},
+		{name: "inject with env", pod: testPod(map[string]string{
+			tokensv1alpha1.InjectAnnotation:    "token",
+			tokensv1alpha1.InjectEnvAnnotation: "TOKEN_FILE",
+		}), allowed: true, patched: true},
+		{name: "missing jwt", pod: testPod(map[string]string{tokensv1alpha1.InjectAnnotation: "missing"})},
+		{name: "relative path", pod: testPod(map[string]string{
+			tokensv1alpha1.InjectAnnotation:     "token",
+			tokensv1alpha1.InjectPathAnnotation: "tokens",
+		})},
+		{name: "mount path in use", pod: testPod(inject, v1.VolumeMount{Name: "data", MountPath: DefaultInjectPath + "/"})},
+	}
+
+	injector := newTestPodInjector(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+				Operation: admissionv1beta1.Create,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: raw},
+			}}
+
+			resp := injector.Handle(context.Background(), req)
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("got allowed %t, want %t: %v", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if patched := len(resp.Patches) > 0; patched != tt.patched {
+				t.Errorf("got patches %v, want patched %t", resp.Patches, tt.patched)
+			}
+		})
+	}
+}
+
+func TestInjectToken(t *testing.T) {
+	pod := testPod(nil)
+	err := injectToken(pod, "token", DefaultInjectPath, "TOKEN_FILE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].Projected.Sources[0].Secret.Name != "token" {
+		t.Fatalf("token secret not added as volume: %v", pod.Spec.Volumes)
+	}
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		if len(c.VolumeMounts) != 1 || c.VolumeMounts[0].MountPath != DefaultInjectPath || !c.VolumeMounts[0].ReadOnly {
+			t.Errorf("container %s: token not mounted: %v", c.Name, c.VolumeMounts)
+		}
+		want := DefaultInjectPath + "/" + controllers.TokenSecretKey
+		if len(c.Env) != 1 || c.Env[0].Name != "TOKEN_FILE" || c.Env[0].Value != want {
+			t.Errorf("container %s: got env %v, want TOKEN_FILE=%s", c.Name, c.Env, want)
+		}
+	}
+
+	// A pod with the volume is not changed again
+	err = injectToken(pod, "token", DefaultInjectPath, "TOKEN_FILE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.Spec.Volumes) != 1 || len(pod.Spec.Containers[0].VolumeMounts) != 1 || len(pod.Spec.Containers[0].Env) != 1 {
+		t.Errorf("token injected twice: %v", pod.Spec)
+	}
+}
+
+func TestInjectTokenMountPathInUse(t *testing.T) {
+	pod := testPod(nil)
+	pod.Spec.InitContainers[0].VolumeMounts = []v1.VolumeMount{{Name: "data", MountPath: DefaultInjectPath}}
+
+	err := injectToken(pod, "token", DefaultInjectPath, "")
+	if err == nil {
+		t.Fatal("token mounted over another volume")
+	}
+	if len(pod.Spec.Volumes) != 0 {
+		t.Errorf("volume added to rejected pod: %v", pod.Spec.Volumes)
+	}
+}